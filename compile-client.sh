@@ -1,5 +1,5 @@
 #!/bin/bash
 cd "$(dirname "$0")/src"
-go build -o ../build/ CloudFort.go CloudFortCore.go Util.go
+go build -o ../build/ CloudFort.go CloudFort-Agent.go CloudFort-Backups.go CloudFort-Checkpoints.go CloudFort-DFProcess.go CloudFort-Journal.go CloudFort-Launcher.go CloudFort-Profiles.go CloudFortCore.go Util.go
 cd ..
 
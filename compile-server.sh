@@ -1,5 +1,5 @@
 #!/bin/bash
 cd "$(dirname "$0")/src"
-go build -o ../build/ CloudFort-Server.go CloudFortCore.go Util.go DemoWorld.go
+go build -o ../build/ CloudFort-Server.go CloudFort-Server-HTTP.go CloudFort-Server-Checkpoints.go CloudFort-Server-Dashboard.go CloudFort-Server-Email.go CloudFort-Server-Events.go CloudFort-Server-Metrics.go CloudFort-Server-Requests.go CloudFort-Server-Webhooks.go CloudFortCore.go Util.go DemoWorld.go
 cd ..
 
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the client agent ("CloudFort agent") keeps running in the background: it watches the server for worlds becoming available,
+// starts Dwarf Fortress and offers to check-in when it closes, and answers the local API used by "CloudFort ctl" and the
+// normal CloudFort client (on 127.0.0.1 only)
+
+const AGENT_PORT = 13139
+
+const (
+	AGENT_KEY_FILE   = "CloudFort-agent.key" // (in the CloudFort folder) a new secret each time the agent starts
+	AGENT_KEY_HEADER = "X-CloudFort-Agent"   // requests to the agent must send the secret in this header
+)
+
+// what the agent knows, returned by GET /status
+type AgentStatus struct {
+	Server     string
+	Overseer   string
+	LastPoll   string                 `json:",omitempty"`
+	PollError  string                 `json:",omitempty"`
+	Worlds     map[string]WorldStatus // as of the last poll
+	Watching   []string
+	CheckedOut []AgentCheckOut
+	DFRunning  bool
+}
+
+// a world that is checked-out to this computer
+type AgentCheckOut struct {
+	World     string
+	Server    string // server profile
+	Expires   string
+	Remaining string // eg "1h25m", or "expired"
+	Queued    bool   `json:",omitempty"` // the overseer asked to check it in, but the server could not be reached yet
+}
+
+type agent struct {
+	lock      sync.Mutex // guards the fields below
+	worlds    map[string]WorldStatus
+	lastPoll  time.Time
+	pollError string
+	dfRunning bool
+
+	opLock     sync.Mutex // only one check-out, check-in or DF exit at a time
+	saveDir    string
+	localDF    DFInstall
+	configFile string
+	config     ClientConfig
+}
+
+// runs the agent until the process is killed
+func runAgent(saveDir string, localDF DFInstall, configFile string, config ClientConfig) error {
+	a := &agent{
+		worlds:     make(map[string]WorldStatus),
+		saveDir:    saveDir,
+		localDF:    localDF,
+		configFile: configFile,
+		config:     config,
+	}
+	logger.Infof("...checking save folders for left-over check-outs...")
+	err := checkWorldDirs(saveDir, config)
+	if err != nil {
+		return err
+	}
+	key, err := newAgentKey()
+	if err != nil {
+		return err
+	}
+	pollInterval, _ := time.ParseDuration(config.PollInterval)
+	go a.poll(pollInterval)
+	go watchExpirations(saveDir, config, make(chan bool))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.handleStatus)
+	mux.HandleFunc("/watch", a.handleWatch)
+	mux.HandleFunc("/unwatch", a.handleWatch)
+	mux.HandleFunc("/checkout", a.handleCheckOut)
+	mux.HandleFunc("/checkin", a.handleCheckIn)
+	mux.HandleFunc("/extend", a.handleExtend)
+	mux.HandleFunc("/reserve", a.handleReserve)
+	mux.HandleFunc("/play", a.handlePlay)
+	mux.HandleFunc("/checkpoint", a.handleCheckpoint)
+	hostStr := fmt.Sprintf("127.0.0.1:%d", config.AgentPortNumber)
+	logger.Infof("CloudFort agent listening on %s, watching %s", hostStr, strings.Join(config.WatchWorlds, ", "))
+	return http.ListenAndServe(hostStr, agentAuthorized(key, mux))
+}
+
+func agentKeyFile() (string, error) {
+	thisFile, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(thisFile), AGENT_KEY_FILE), nil
+}
+
+// makes a new secret for the local API and writes it to a file that only this user can read
+func newAgentKey() (string, error) {
+	bb := make([]byte, 32)
+	_, err := rand.Read(bb)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to make a key for the agent")
+	}
+	key := hex.EncodeToString(bb)
+	keyFile, err := agentKeyFile()
+	if err != nil {
+		return "", err
+	}
+	// (removed first, as WriteFile does not change the permissions of an existing file)
+	os.Remove(keyFile)
+	err = ioutil.WriteFile(keyFile, []byte(key), 0600)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to write the agent key")
+	}
+	return key, nil
+}
+
+// only lets through requests with the agent key, and none from web pages (which browsers mark with an Origin header),
+// so that a web site can't use the local API
+func agentAuthorized(key string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			agentRefuse(w, errors.New("Requests from web pages are not allowed"))
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(AGENT_KEY_HEADER)), []byte(key)) != 1 {
+			agentRefuse(w, errors.New(fmt.Sprintf("Missing or wrong %s header (the key is in %s)", AGENT_KEY_HEADER, AGENT_KEY_FILE)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func agentRefuse(w http.ResponseWriter, err error) {
+	logger.Warnf("Agent request refused: %v", err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	jstr, _ := json.MarshalIndent(map[string]string{"Error": err.Error()}, "", "\t")
+	w.Write(append(jstr, '\n'))
+}
+
+// asks the server for the status of all worlds every pollInterval, telling the overseer about any news
+func (a *agent) poll(pollInterval time.Duration) {
+	for {
+		config := a.currentConfig()
+		msg, err := textServer(config.server, COM_STATUS)
+		var worlds map[string]WorldStatus
+		if err == nil {
+			err = json.Unmarshal([]byte(msg), &worlds)
+		}
+		a.lock.Lock()
+		a.lastPoll = time.Now()
+		if err != nil {
+			a.pollError = err.Error()
+			logger.Warnf("Failed to get world status from server: %v", err)
+		} else {
+			a.pollError = ""
+			a.notify(a.worlds, worlds)
+			a.worlds = worlds
+		}
+		dfRunning := a.dfRunning
+		a.lock.Unlock()
+		if err == nil && !dfRunning {
+			// the server can be reached, so check-ins that were waiting for it can be finished
+			if ops, _ := loadJournal(a.saveDir); len(ops) > 0 {
+				a.opLock.Lock()
+				replayJournal(a.saveDir, config)
+				a.opLock.Unlock()
+			}
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// compares the old and new world status, announcing turns and watched worlds that became available (call with a.lock held)
+func (a *agent) notify(old map[string]WorldStatus, worlds map[string]WorldStatus) {
+	me := a.config.OverseerName
+	for world, ws := range worlds {
+		was, known := old[world]
+		if ws.ReservedFor == me && (!known || was.ReservedFor != me) {
+			msg := fmt.Sprintf("It is your turn to play world '%s'!", world)
+			if t, err := time.Parse(time.RFC3339, ws.ReservedUntil); err == nil {
+				msg = fmt.Sprintf("%s It is reserved for you until %s.", msg, t.Local().Format("15:04"))
+			}
+			logger.Infof("%s", msg)
+			go infoPopup("Your turn!", msg)
+			continue
+		}
+		if !containsString(a.config.WatchWorlds, world) || !agentCanCheckOut(ws, me) {
+			continue
+		}
+		if !known || !agentCanCheckOut(was, me) {
+			msg := fmt.Sprintf("World '%s' is available to check-out.", world)
+			logger.Infof("%s", msg)
+			go infoPopup("World available!", msg)
+		}
+	}
+}
+
+// a copy of the config, which /watch can change while other requests use it
+func (a *agent) currentConfig() ClientConfig {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.config
+}
+
+func agentCanCheckOut(ws WorldStatus, overseer string) bool {
+	return ws.Status == STATUS_AVAILABLE && (ws.ReservedFor == "" || ws.ReservedFor == overseer)
+}
+
+func (a *agent) status() AgentStatus {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	st := AgentStatus{
+		Server:    fmt.Sprintf("%s:%d", a.config.HostName, a.config.PortNumber),
+		Overseer:  a.config.OverseerName,
+		PollError: a.pollError,
+		Worlds:    a.worlds,
+		Watching:  a.config.WatchWorlds,
+		DFRunning: a.dfRunning,
+	}
+	if !a.lastPoll.IsZero() {
+		st.LastPoll = a.lastPoll.Format(time.RFC3339)
+	}
+	queued := make(map[string]bool)
+	ops, _ := loadJournal(a.saveDir)
+	for _, op := range ops {
+		queued[op.World] = true
+	}
+	worldDirs, _ := listDirs(a.saveDir)
+	for _, worldDir := range worldDirs {
+		token, err := readTokenFile(worldDir)
+		if err != nil {
+			continue
+		}
+		co := AgentCheckOut{World: filepath.Base(worldDir), Server: token.Server, Expires: token.Expires, Queued: queued[filepath.Base(worldDir)]}
+		if expires, err := time.Parse(time.RFC3339, token.Expires); err == nil {
+			remaining := time.Until(expires)
+			if remaining > 0 {
+				co.Remaining = remaining.Round(time.Minute).String()
+			} else {
+				co.Remaining = "expired"
+			}
+		}
+		st.CheckedOut = append(st.CheckedOut, co)
+	}
+	return st
+}
+
+func (a *agent) handleStatus(w http.ResponseWriter, r *http.Request) {
+	agentReply(w, a.status(), nil)
+}
+
+// POST /watch?world=... and /unwatch?world=...: changes WatchWorlds and saves it in the config file
+func (a *agent) handleWatch(w http.ResponseWriter, r *http.Request) {
+	world, ok := agentWorldParam(w, r)
+	if !ok {
+		return
+	}
+	// the config file is read again so that only WatchWorlds is changed in it
+	fileConfig, err := loadClientConfig(a.configFile)
+	if err != nil {
+		agentReply(w, nil, err)
+		return
+	}
+	a.lock.Lock()
+	watching := make([]string, 0, len(a.config.WatchWorlds)+1)
+	for _, wn := range a.config.WatchWorlds {
+		if wn != world {
+			watching = append(watching, wn)
+		}
+	}
+	if r.URL.Path == "/watch" {
+		watching = append(watching, world)
+		sort.Strings(watching)
+	}
+	a.config.WatchWorlds = watching
+	a.lock.Unlock()
+	fileConfig.WatchWorlds = watching
+	err = saveClientConfig(a.configFile, fileConfig)
+	agentReply(w, map[string][]string{"Watching": watching}, err)
+}
+
+// POST /checkout?world=...: checks-out a world to the save folder (use /play to start Dwarf Fortress)
+func (a *agent) handleCheckOut(w http.ResponseWriter, r *http.Request) {
+	world, ok := agentWorldParam(w, r)
+	if !ok {
+		return
+	}
+	a.lock.Lock()
+	ws, known := a.worlds[world]
+	a.lock.Unlock()
+	if known && ws.DFVersion != "" && a.localDF.Version != "" && !sameDFVersion(ws.DFVersion, a.localDF.Version) {
+		if !askUser(fmt.Sprintf("World '%s' is played with Dwarf Fortress %s, but you have Dwarf Fortress %s. Playing a world with the wrong version of Dwarf Fortress can corrupt it. Check-out anyway?", world, ws.DFVersion, a.localDF.Version), "Wrong Dwarf Fortress version") {
+			agentReply(w, nil, errors.New("Check-out cancelled because of the wrong Dwarf Fortress version"))
+			return
+		}
+	}
+	a.opLock.Lock()
+	defer a.opLock.Unlock()
+	err := checkOut(world, a.saveDir, a.localDF, a.currentConfig())
+	agentReply(w, map[string]string{"World": world, "Result": "checked-out"}, err)
+}
+
+// POST /checkin?world=...: checks-in a world from the save folder (not while Dwarf Fortress is running)
+func (a *agent) handleCheckIn(w http.ResponseWriter, r *http.Request) {
+	world, ok := agentWorldParam(w, r)
+	if !ok {
+		return
+	}
+	a.opLock.Lock()
+	defer a.opLock.Unlock()
+	a.lock.Lock()
+	dfRunning := a.dfRunning
+	a.lock.Unlock()
+	if dfRunning {
+		agentReply(w, nil, errors.New("Quit Dwarf Fortress before checking-in a world"))
+		return
+	}
+	worldDir := filepath.Join(a.saveDir, world)
+	token, err := readTokenFile(worldDir)
+	if err != nil {
+		agentReply(w, nil, errors.Wrapf(err, "World %s is not checked-out", world))
+		return
+	}
+	wconfig, err := a.currentConfig().forServer(token.Server)
+	if err != nil {
+		agentReply(w, nil, err)
+		return
+	}
+	err = checkIn(worldDir, token, wconfig)
+	if isOffline(err) {
+		logger.Warnf("Check-in of world %s failed: %v", world, err)
+		agentReply(w, map[string]string{"World": world, "Result": "queued until the server can be reached"}, nil)
+		return
+	}
+	agentReply(w, map[string]string{"World": world, "Result": "checked-in"}, err)
+}
+
+// POST /checkpoint?world=...: uploads the world's save as a checkpoint (it stays checked-out)
+func (a *agent) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	world, ok := agentWorldParam(w, r)
+	if !ok {
+		return
+	}
+	worldDir := filepath.Join(a.saveDir, world)
+	token, err := readTokenFile(worldDir)
+	if err != nil {
+		agentReply(w, nil, errors.Wrapf(err, "World %s is not checked-out", world))
+		return
+	}
+	wconfig, err := a.currentConfig().forServer(token.Server)
+	if err == nil {
+		err = checkpoint(worldDir, token, wconfig)
+	}
+	agentReply(w, map[string]string{"World": world, "Result": "checkpoint saved"}, err)
+}
+
+// POST /extend?world=...: asks the server for more time
+func (a *agent) handleExtend(w http.ResponseWriter, r *http.Request) {
+	world, ok := agentWorldParam(w, r)
+	if !ok {
+		return
+	}
+	worldDir := filepath.Join(a.saveDir, world)
+	token, err := readTokenFile(worldDir)
+	if err != nil {
+		agentReply(w, nil, errors.Wrapf(err, "World %s is not checked-out", world))
+		return
+	}
+	wconfig, err := a.currentConfig().forServer(token.Server)
+	if err == nil {
+		token, err = extendCheckOut(worldDir, token, wconfig)
+	}
+	agentReply(w, map[string]string{"World": world, "Expires": token.Expires}, err)
+}
+
+// POST /reserve?world=...: joins the queue for a world
+func (a *agent) handleReserve(w http.ResponseWriter, r *http.Request) {
+	world, ok := agentWorldParam(w, r)
+	if !ok {
+		return
+	}
+	config := a.currentConfig()
+	resp, err := textServer(config.server, fmt.Sprintf("%s:%s:%s", COM_RESERVE, config.OverseerName, world))
+	if err == nil && strings.HasPrefix(resp, RESP_ERROR) {
+		err = errors.New(strings.TrimSpace(resp))
+	}
+	agentReply(w, map[string]string{"World": world, "Result": "reserved"}, err)
+}
+
+// POST /play: starts Dwarf Fortress, offering to check-in the checked-out worlds when it closes
+func (a *agent) handlePlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		agentReply(w, nil, errors.New("Use POST"))
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.dfRunning {
+		agentReply(w, map[string]string{"Result": "already running"}, nil)
+		return
+	}
+	if a.config.Launcher.NoLaunch {
+		agentReply(w, nil, errors.New("CloudFort is set not to start Dwarf Fortress (Launcher NoLaunch), start it yourself"))
+		return
+	}
+	logger.Infof("Starting Dwarf Fortress...")
+	dfCmd := dfCommand(a.localDF, a.config.Launcher)
+	err := dfCmd.Start()
+	if err != nil {
+		agentReply(w, nil, errors.Wrapf(err, "Failed to start %s", a.localDF.Executable))
+		return
+	}
+	a.dfRunning = true
+	checkpointDone := make(chan bool)
+	go autoCheckpoint(a.saveDir, a.config, checkpointDone)
+	go func() {
+		_ = dfCmd.Wait() // DF returns error code even on normal exit
+		checkpointDone <- true
+		a.lock.Lock()
+		a.dfRunning = false
+		a.lock.Unlock()
+		logger.Infof("...DF closed. Checking-in CloudFort worlds...")
+		a.opLock.Lock()
+		defer a.opLock.Unlock()
+		err := checkWorldDirs(a.saveDir, a.currentConfig())
+		if err != nil {
+			logger.Errorf("%v", err)
+			errorPopup(fmt.Sprintf("%v", err))
+		}
+	}()
+	agentReply(w, map[string]string{"Result": "started"}, nil)
+}
+
+// reads the world parameter of a POST request, replying with an error if there is none
+func agentWorldParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost {
+		agentReply(w, nil, errors.New("Use POST"))
+		return "", false
+	}
+	world := r.URL.Query().Get("world")
+	if world == "" || strings.ContainsAny(world, `:/\`) || world == "." || world == ".." {
+		agentReply(w, nil, errors.New(fmt.Sprintf("Invalid world name '%s'", world)))
+		return "", false
+	}
+	return world, true
+}
+
+// writes a JSON reply, or {"Error": "..."}
+func agentReply(w http.ResponseWriter, v interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		logger.Warnf("Agent request failed: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		v = map[string]string{"Error": err.Error()}
+	}
+	jstr, _ := json.MarshalIndent(v, "", "\t")
+	w.Write(append(jstr, '\n'))
+}
+
+// sends a command to the local agent; "status" is a GET, everything else a POST with the world (if any)
+func agentRequest(config ClientConfig, command string, world string) ([]byte, error) {
+	u := fmt.Sprintf("http://127.0.0.1:%d/%s", config.AgentPortNumber, command)
+	if world != "" {
+		u = fmt.Sprintf("%s?world=%s", u, url.QueryEscape(world))
+	}
+	keyFile, err := agentKeyFile()
+	if err != nil {
+		return nil, err
+	}
+	// (no key file means that the agent has never been started)
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	method := http.MethodPost
+	client := http.Client{Timeout: 10 * time.Minute} // check-outs and check-ins can take a while
+	if command == "status" {
+		method = http.MethodGet
+		client.Timeout = 2 * time.Second
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(AGENT_KEY_HEADER, strings.TrimSpace(string(key)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e map[string]string
+		if json.Unmarshal(body, &e) == nil && e["Error"] != "" {
+			return nil, errors.New(e["Error"])
+		}
+		return nil, errors.New(resp.Status)
+	}
+	return body, nil
+}
+
+// whether an agent is answering on the configured port
+func agentIsRunning(config ClientConfig) bool {
+	_, err := agentRequest(config, "status", "")
+	return err == nil
+}
+
+// the "ctl" subcommand: talks to a running agent from the command line
+func agentCtl(args []string) int {
+	usage := "Usage: CloudFort ctl status | play | watch <world> | unwatch <world> | checkout <world> | checkin <world> | checkpoint <world> | extend <world> | reserve <world>"
+	if len(args) == 0 || (args[0] != "status" && args[0] != "play" && len(args) != 2) {
+		fmt.Println(usage)
+		return 2
+	}
+	config := defaultClientConfig()
+	thisFile, err := os.Executable()
+	if err == nil {
+		config, _ = loadClientConfig(filepath.Join(filepath.Dir(thisFile), "CloudFort-config.json"))
+	}
+	world := ""
+	if len(args) == 2 {
+		world = args[1]
+	}
+	body, err := agentRequest(config, args[0], world)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	if args[0] != "status" {
+		fmt.Print(string(body))
+		return 0
+	}
+	var st AgentStatus
+	err = json.Unmarshal(body, &st)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Server %s, overseer %s, last checked %s\n", st.Server, st.Overseer, st.LastPoll)
+	if st.PollError != "" {
+		fmt.Printf("Server problem: %s\n", st.PollError)
+	}
+	if st.DFRunning {
+		fmt.Println("Dwarf Fortress is running")
+	}
+	for _, co := range st.CheckedOut {
+		fmt.Printf("Checked-out: %s from %s, expires %s (%s left)\n", co.World, co.Server, co.Expires, co.Remaining)
+		if co.Queued {
+			fmt.Println("  check-in queued until the server can be reached")
+		}
+	}
+	names := make([]string, 0, len(st.Worlds))
+	for world := range st.Worlds {
+		names = append(names, world)
+	}
+	sort.Strings(names)
+	for _, world := range names {
+		ws := st.Worlds[world]
+		line := fmt.Sprintf("%-20s %s", world, ws.Status)
+		if ws.ReservedFor != "" {
+			line = fmt.Sprintf("%s, reserved for %s", line, ws.ReservedFor)
+		}
+		if containsString(st.Watching, world) {
+			line = fmt.Sprintf("%s (watching)", line)
+		}
+		fmt.Println(line)
+	}
+	return 0
+}
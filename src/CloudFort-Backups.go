@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gen2brain/dlgs"
+)
+
+// local backups of the saves that were checked-in and checked-out, in data/cloudfort-backups/<world>/<time>-<kind>.zip
+// so that a world can be recovered from the overseers' computers if something happens to the server
+
+const (
+	BACKUP_CHECKIN     = "checkin"
+	BACKUP_CHECKOUT    = "checkout"
+	BACKUP_TIME_FORMAT = "20060102-150405"
+)
+
+// a backup zip, as found by listBackups
+type Backup struct {
+	World string
+	Time  time.Time
+	Kind  string // BACKUP_CHECKIN or BACKUP_CHECKOUT
+	Path  string
+}
+
+// saved next to a backup zip as <time>-<kind>.json, with what is needed to restore it
+type BackupInfo struct {
+	SaveFiles []string // the world's extra save file patterns, as in LockToken
+}
+
+func (b Backup) String() string {
+	return fmt.Sprintf("%s: %s (%s)", b.World, b.Time.Local().Format("2006-01-02 15:04:05"), b.Kind)
+}
+
+func backupFolder(saveDir string) string {
+	return filepath.Join(filepath.Dir(saveDir), "cloudfort-backups")
+}
+
+// the file next to a backup zip with its BackupInfo
+func backupInfoPath(backupPath string) string {
+	return strings.TrimSuffix(backupPath, ".zip") + ".json"
+}
+
+// copies a save zip to the backups of a world, then deletes the oldest backups of the same kind beyond BackupsKept
+// (saveFiles are the world's extra save file patterns, which are needed to restore it)
+func backupSave(zipPath string, saveDir string, world string, kind string, saveFiles []string, config ClientConfig) error {
+	if config.BackupsKept <= 0 {
+		return nil
+	}
+	worldBackups := filepath.Join(backupFolder(saveDir), world)
+	err := os.MkdirAll(worldBackups, 0777)
+	if err != nil {
+		return err
+	}
+	backupPath := filepath.Join(worldBackups, fmt.Sprintf("%s-%s.zip", time.Now().UTC().Format(BACKUP_TIME_FORMAT), kind))
+	logger.Infof("Backing up %s to %s", world, backupPath)
+	err = copyFile(zipPath, backupPath)
+	if err != nil {
+		return err
+	}
+	if len(saveFiles) > 0 {
+		jstr, _ := json.MarshalIndent(BackupInfo{SaveFiles: saveFiles}, "", "\t")
+		err = ioutil.WriteFile(backupInfoPath(backupPath), jstr, 0664)
+		if err != nil {
+			return err
+		}
+	}
+	backups, err := listFiles(worldBackups, fmt.Sprintf("-%s.zip", kind))
+	if err != nil {
+		return err
+	}
+	// the names start with the time, so the newest sort first in reverse
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i := config.BackupsKept; i < len(backups); i++ {
+		logger.Debugf("Deleting old backup %s", backups[i])
+		err = os.Remove(backups[i])
+		if err != nil {
+			return err
+		}
+		if fileExists(backupInfoPath(backups[i])) {
+			err = os.Remove(backupInfoPath(backups[i]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reads the BackupInfo of a backup (backups without one have no extra save files)
+func readBackupInfo(b Backup) (BackupInfo, error) {
+	var info BackupInfo
+	if !fileExists(backupInfoPath(b.Path)) {
+		return info, nil
+	}
+	jstr, err := ioutil.ReadFile(backupInfoPath(b.Path))
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(jstr, &info)
+	if err != nil {
+		return info, errors.Wrapf(err, "Failed to parse %s", backupInfoPath(b.Path))
+	}
+	return info, nil
+}
+
+// lists the backups of every world, newest first
+func listBackups(saveDir string) ([]Backup, error) {
+	var backups []Backup
+	worldDirs, err := listDirs(backupFolder(saveDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return backups, nil
+		}
+		return backups, err
+	}
+	for _, worldDir := range worldDirs {
+		zips, err := listFiles(worldDir, ".zip")
+		if err != nil {
+			return backups, err
+		}
+		for _, z := range zips {
+			name := strings.TrimSuffix(filepath.Base(z), ".zip")
+			i := strings.LastIndex(name, "-")
+			if i < 0 {
+				continue
+			}
+			t, err := time.Parse(BACKUP_TIME_FORMAT, name[:i])
+			if err != nil {
+				continue
+			}
+			backups = append(backups, Backup{World: filepath.Base(worldDir), Time: t, Kind: name[i+1:], Path: z})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// extracts a backup into the save folder as an ordinary save (not checked-out, so it is never checked-in)
+func restoreBackup(b Backup, saveDir string) (string, error) {
+	destDir := filepath.Join(saveDir, fmt.Sprintf("%s-restored-%s", b.World, b.Time.Format(BACKUP_TIME_FORMAT)))
+	if fileExists(destDir) {
+		return destDir, errors.New(fmt.Sprintf("Save folder %s already exists", destDir))
+	}
+	info, err := readBackupInfo(b)
+	if err != nil {
+		return destDir, err
+	}
+	zroot, err := findSaveZipRoot(b.Path)
+	if err != nil {
+		return destDir, err
+	}
+	err = unzipFiles(b.Path, zroot, destDir, saveFileMatcher(isSaveFile, info.SaveFiles))
+	if err != nil {
+		deleteDir(destDir)
+		return destDir, err
+	}
+	return destDir, nil
+}
+
+// the "restore" subcommand: CloudFort restore [<world> [<time>]]
+// restores the newest backup of the world, or the one at the given time (as in the file name),
+// or else lets the overseer pick one
+func restoreCommand(saveDir string, args []string) error {
+	backups, err := listBackups(saveDir)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		matching := make([]Backup, 0, len(backups))
+		for _, b := range backups {
+			if b.World == args[0] && (len(args) < 2 || b.Time.Format(BACKUP_TIME_FORMAT) == args[1]) {
+				matching = append(matching, b)
+			}
+		}
+		backups = matching
+	}
+	if len(backups) == 0 && len(args) > 0 {
+		return errors.New(fmt.Sprintf("There is no matching backup of world '%s' in %s", args[0], backupFolder(saveDir)))
+	} else if len(backups) == 0 {
+		return errors.New(fmt.Sprintf("There are no backups to restore in %s", backupFolder(saveDir)))
+	}
+	chosen := backups[0]
+	if len(args) == 0 {
+		labels := make([]string, 0, len(backups))
+		label2Backup := make(map[string]Backup)
+		for _, b := range backups {
+			labels = append(labels, b.String())
+			label2Backup[b.String()] = b
+		}
+		item, ok, err := dlgs.List("CloudFort Backups", "Select a backup to restore:", labels)
+		if err != nil {
+			return err
+		}
+		if !ok || item == "" {
+			return nil
+		}
+		chosen = label2Backup[item]
+	}
+	logger.Infof("Restoring backup %s", chosen.Path)
+	destDir, err := restoreBackup(chosen, saveDir)
+	if err != nil {
+		return err
+	}
+	infoPopup("Backup restored", fmt.Sprintf("The backup of world '%s' from %s is now in the save folder as %s. It is not checked-out, so it will not be checked-in. To put it back on a server, give the server's admin the backup file %s",
+		chosen.World, chosen.Time.Local().Format("2006-01-02 15:04"), filepath.Base(destDir), chosen.Path))
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// checkpoints upload the save of a checked-out world to the server while it stays checked-out,
+// so that the turn is not lost if this computer dies before the check-in
+
+// how long the save files must be left alone before an automatic checkpoint, so that DF is not in the middle of saving
+const CHECKPOINT_SETTLE_TIME = time.Minute
+
+// uploads the current save of a checked-out world as its latest checkpoint
+func checkpoint(worldDir string, token LockToken, config ClientConfig) error {
+	world := filepath.Base(worldDir)
+	logger.Infof("Checkpointing world %s", world)
+	err := waitForStableSave(worldDir, config)
+	if err != nil {
+		return err
+	}
+	zipPath, hash, zipSize, err := zipSave(worldDir, config.local, token.SaveFiles)
+	if zipPath != "" {
+		defer os.Remove(zipPath)
+	}
+	if err != nil {
+		return err
+	}
+	connection, err := dialServer(config.server)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to connect to server %s:%d", config.HostName, config.PortNumber)
+	}
+	defer connection.Close()
+	serverReader := bufio.NewReader(connection)
+	_, err = connection.Write(strToUtf8(fmt.Sprintf("%s:%s:%s:%s\n", COM_CHECKPOINT, config.OverseerName, world, token.MagicRunes)))
+	if err != nil {
+		return err
+	}
+	resp, err := serverReader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(resp) != RESP_UPLOAD {
+		return errors.New(strings.TrimSpace(resp))
+	}
+	_, err = connection.Write(strToUtf8(fmt.Sprintf("%s\n", hash)))
+	if err != nil {
+		return err
+	}
+	tf, err := os.Open(zipPath)
+	if err != nil {
+		return err
+	}
+	err = sendFile(tf, connection, zipSize, true)
+	tf.Close()
+	if err != nil {
+		return err
+	}
+	resp, err = serverReader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(resp) != RESP_SUCCESS {
+		return errors.New(strings.TrimSpace(resp))
+	}
+	logger.Infof("Checkpoint of world %s saved on the server", world)
+	return nil
+}
+
+// the "checkpoint" subcommand: CloudFort checkpoint [<world>]
+// checkpoints the named world, or every checked-out world
+func checkpointCommand(saveDir string, args []string, config ClientConfig) error {
+	worlds := checkedOutWorlds(saveDir)
+	if len(args) > 0 {
+		if !containsString(worlds, args[0]) {
+			return errors.New(fmt.Sprintf("World %s is not checked-out", args[0]))
+		}
+		worlds = args[:1]
+	}
+	if len(worlds) == 0 {
+		return errors.New("There are no checked-out worlds to checkpoint")
+	}
+	for _, world := range worlds {
+		worldDir := filepath.Join(saveDir, world)
+		token, err := readTokenFile(worldDir)
+		if err != nil {
+			return err
+		}
+		wconfig, err := config.forServer(token.Server)
+		if err != nil {
+			return err
+		}
+		err = checkpoint(worldDir, token, wconfig)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to checkpoint world %s", world)
+		}
+	}
+	return nil
+}
+
+// while DF runs, checkpoints every checked-out world each AutoCheckpoint interval, if it was saved since its last checkpoint
+// (or since DF was started), doing nothing if AutoCheckpoint is not set
+func autoCheckpoint(saveDir string, config ClientConfig, done chan bool) {
+	interval, err := time.ParseDuration(config.AutoCheckpoint)
+	if config.AutoCheckpoint == "" || err != nil || interval <= 0 {
+		<-done
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	checkpointed := make(map[string]time.Time) // newest save file time at the last checkpoint of each world
+	for _, world := range checkedOutWorlds(saveDir) {
+		checkpointed[world], _ = lastSaved(filepath.Join(saveDir, world), config.local)
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, world := range checkedOutWorlds(saveDir) {
+				worldDir := filepath.Join(saveDir, world)
+				saved, err := lastSaved(worldDir, config.local)
+				if err != nil || !saved.After(checkpointed[world]) || time.Since(saved) < CHECKPOINT_SETTLE_TIME {
+					continue
+				}
+				token, err := readTokenFile(worldDir)
+				var wconfig ClientConfig
+				if err == nil {
+					wconfig, err = config.forServer(token.Server)
+				}
+				if err == nil {
+					err = checkpoint(worldDir, token, wconfig)
+				}
+				if err != nil {
+					logger.Warnf("Automatic checkpoint of world %s failed: %v", world, err)
+					continue
+				}
+				checkpointed[world] = saved
+			}
+		}
+	}
+}
+
+// the modification time of the newest save file in a world folder
+func lastSaved(worldDir string, localDF DFInstall) (time.Time, error) {
+	var newest time.Time
+	saveFiles, err := scanDir(worldDir)
+	if err != nil {
+		return newest, err
+	}
+	for _, f := range localDF.saveFiles(worldDir, saveFiles, nil) {
+		fstat, err := os.Stat(f)
+		if err != nil {
+			return newest, err
+		}
+		if fstat.ModTime().After(newest) {
+			newest = fstat.ModTime()
+		}
+	}
+	return newest, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// names of the Dwarf Fortress executables (and the scripts that start them) on each platform
+var dfProcessNames = []string{"Dwarf Fortress.exe", "dfhack", "df", "Dwarf_Fortress", "dwarfort"}
+
+const (
+	SAVE_WAIT_LIMIT = 2 * time.Minute  // how long to wait for a save to stop changing before giving up
+	DF_EXIT_WAIT    = 30 * time.Second // how long to wait for Dwarf Fortress to close before check-ins are refused
+)
+
+// whether a Dwarf Fortress from the given folder is running (false if that can't be found out)
+func dfIsRunning(dfDir string) bool {
+	running, err := findDFProcess(dfDir)
+	if err != nil {
+		logger.Warnf("Could not find out whether Dwarf Fortress is running: %v", err)
+		return false
+	}
+	return running
+}
+
+// waits up to the given time for Dwarf Fortress to close, returning whether it is still running
+func waitForDFToClose(dfDir string, limit time.Duration) bool {
+	deadline := time.Now().Add(limit)
+	if !dfIsRunning(dfDir) {
+		return false
+	}
+	logger.Infof("Waiting for Dwarf Fortress to close...")
+	for time.Now().Before(deadline) {
+		time.Sleep(2 * time.Second)
+		if !dfIsRunning(dfDir) {
+			return false
+		}
+	}
+	return true
+}
+
+func findDFProcess(dfDir string) (bool, error) {
+	self, _ := os.Executable()
+	var paths []string
+	switch runtime.GOOS {
+	case "linux":
+		// the executable of each process, and its arguments in case it is a script like dfhack
+		procs, err := filepath.Glob("/proc/[0-9]*")
+		if err != nil {
+			return false, err
+		}
+		for _, proc := range procs {
+			if exe, err := os.Readlink(filepath.Join(proc, "exe")); err == nil {
+				paths = append(paths, exe)
+			}
+			cmdline, err := ioutil.ReadFile(filepath.Join(proc, "cmdline"))
+			if err != nil {
+				continue
+			}
+			cwd, _ := os.Readlink(filepath.Join(proc, "cwd"))
+			for _, arg := range strings.Split(string(cmdline), "\x00") {
+				if arg != "" && !filepath.IsAbs(arg) && cwd != "" {
+					// (eg ./dfhack)
+					arg = filepath.Join(cwd, arg)
+				}
+				paths = append(paths, arg)
+			}
+		}
+	case "windows":
+		out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", "Get-Process | ForEach-Object { $_.Path }").Output()
+		if err != nil {
+			return false, errors.Wrap(err, "Failed to list processes")
+		}
+		paths = strings.Split(strings.ReplaceAll(string(out), "\r", ""), "\n")
+	default:
+		out, err := exec.Command("ps", "-axo", "comm=").Output()
+		if err != nil {
+			return false, errors.Wrap(err, "Failed to list processes")
+		}
+		paths = strings.Split(string(out), "\n")
+	}
+	for _, p := range paths {
+		if isDFProcess(strings.TrimSpace(p), dfDir, self) {
+			logger.Debugf("Dwarf Fortress is running: %s", p)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// whether a process's executable (or script) is Dwarf Fortress in the given folder (and not CloudFort itself)
+func isDFProcess(path string, dfDir string, self string) bool {
+	if path == "" || !filepath.IsAbs(path) || path == self {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		path = strings.ToLower(path)
+		dfDir = strings.ToLower(dfDir)
+	}
+	rel, err := filepath.Rel(dfDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	for _, name := range dfProcessNames {
+		if strings.EqualFold(filepath.Base(path), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// the SaveSettleTime setting (which is checked by sanityCheck)
+func (config ClientConfig) settleTime() time.Duration {
+	d, _ := time.ParseDuration(config.SaveSettleTime)
+	return d
+}
+
+// waits until the save files of a world have not changed for SaveSettleTime, so that they are not zipped while
+// Dwarf Fortress is writing them, giving up after SAVE_WAIT_LIMIT
+func waitForStableSave(worldDir string, config ClientConfig) error {
+	stable := config.settleTime()
+	deadline := time.Now().Add(SAVE_WAIT_LIMIT)
+	for {
+		saved, err := lastSaved(worldDir, config.local)
+		if err != nil {
+			return err
+		}
+		quiet := time.Since(saved)
+		if quiet >= stable {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("The save of world %s is still changing, try again when Dwarf Fortress has finished saving", filepath.Base(worldDir)))
+		}
+		wait := stable - quiet
+		if wait > stable {
+			// (a modification time in the future)
+			wait = stable
+		}
+		logger.Infof("Waiting for Dwarf Fortress to finish saving world %s...", filepath.Base(worldDir))
+		time.Sleep(wait)
+	}
+}
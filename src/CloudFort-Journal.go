@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the journal, cloudfort-journal.json next to the save folder, lists the operations that were started but not
+// known to be finished, so that they can be finished the next time CloudFort starts
+type PendingOp struct {
+	OpID    string // sent with the request, so that the server can tell a retry from a new request
+	Type    string
+	World   string
+	Server  string // server profile, as in the world's token.dftk
+	Started string
+}
+
+const OP_CHECKIN = "checkin"
+
+// how long to wait before retrying queued check-ins, doubling after each failure up to the maximum
+const (
+	QUEUE_RETRY_MIN = 30 * time.Second
+	QUEUE_RETRY_MAX = 10 * time.Minute
+)
+
+var journalLock sync.Mutex
+
+func journalPath(saveDir string) string {
+	return filepath.Join(filepath.Dir(saveDir), "cloudfort-journal.json")
+}
+
+func loadJournal(saveDir string) ([]PendingOp, error) {
+	var ops []PendingOp
+	journalFile := journalPath(saveDir)
+	if !fileExists(journalFile) {
+		return ops, nil
+	}
+	jstr, err := ioutil.ReadFile(journalFile)
+	if err != nil {
+		return ops, err
+	}
+	err = json.Unmarshal(jstr, &ops)
+	if err != nil {
+		return ops, errors.Wrapf(err, "Failed to parse %s", journalFile)
+	}
+	return ops, nil
+}
+
+func saveJournal(saveDir string, ops []PendingOp) error {
+	journalFile := journalPath(saveDir)
+	if len(ops) == 0 {
+		if fileExists(journalFile) {
+			return os.Remove(journalFile)
+		}
+		return nil
+	}
+	jstr, _ := json.MarshalIndent(ops, "", "\t")
+	// write a new file and swap it in, so that a crash never leaves half a journal
+	tmpFile := journalFile + ".temp"
+	err := ioutil.WriteFile(tmpFile, jstr, 0664)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, journalFile)
+}
+
+// records an operation in the journal before it is sent to the server
+// (if the same operation is already pending, it is returned instead, so that the retry has the same ID)
+func beginOp(saveDir string, opType string, world string, server string) (PendingOp, error) {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	ops, err := loadJournal(saveDir)
+	if err != nil {
+		return PendingOp{}, err
+	}
+	for _, op := range ops {
+		if op.Type == opType && op.World == world && op.Server == server {
+			return op, nil
+		}
+	}
+	op := PendingOp{OpID: newOpID(), Type: opType, World: world, Server: server, Started: time.Now().Format(time.RFC3339)}
+	return op, saveJournal(saveDir, append(ops, op))
+}
+
+// removes a finished (or abandoned) operation from the journal
+func endOp(saveDir string, opID string) error {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	ops, err := loadJournal(saveDir)
+	if err != nil {
+		return err
+	}
+	kept := make([]PendingOp, 0, len(ops))
+	for _, op := range ops {
+		if op.OpID != opID {
+			kept = append(kept, op)
+		}
+	}
+	return saveJournal(saveDir, kept)
+}
+
+// like endOp, for operations that failed anyway (a journal that can't be written is only logged)
+func dropOp(saveDir string, opID string) {
+	if err := endOp(saveDir, opID); err != nil {
+		logger.Warnf("Failed to update the journal: %v", err)
+	}
+}
+
+func newOpID() string {
+	bb := make([]byte, 16)
+	_, err := rand.Read(bb)
+	if err != nil {
+		// crypto random not working, fall-back mode
+		return fmt.Sprintf("op-%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(bb)
+}
+
+// finishes the operations that were interrupted last time (eg by a crash or a lost connection)
+// if the server already has an interrupted check-in, retrying it just cleans up the local folder
+func replayJournal(saveDir string, config ClientConfig) {
+	ops, err := loadJournal(saveDir)
+	if err != nil {
+		logger.Warnf("Failed to read the journal: %v", err)
+		return
+	}
+	for _, op := range ops {
+		worldDir := filepath.Join(saveDir, op.World)
+		tokenPath := filepath.Join(worldDir, "token.dftk")
+		if op.Type != OP_CHECKIN || !fileExists(tokenPath) {
+			// the check-in finished but CloudFort stopped before the journal was updated
+			dropOp(saveDir, op.OpID)
+			continue
+		}
+		token, err := readTokenFile(worldDir)
+		var wconfig ClientConfig
+		if err == nil {
+			wconfig, err = config.forServer(op.Server)
+		}
+		if err == nil {
+			logger.Infof("Retrying the check-in of world %s (started %s)", op.World, op.Started)
+			err = checkIn(worldDir, token, wconfig)
+		}
+		if err != nil {
+			// left for checkWorldDirs to sort out with the overseer
+			logger.Warnf("Could not finish the check-in of world %s: %v", op.World, err)
+		}
+	}
+}
+
+// keeps retrying the queued check-ins until they are all done or their check-outs have all expired
+// (or until stop is closed, if it is not nil)
+func retryQueuedCheckIns(saveDir string, config ClientConfig, stop <-chan bool) {
+	delay := QUEUE_RETRY_MIN
+	for {
+		ops, err := loadJournal(saveDir)
+		if err != nil {
+			logger.Warnf("Failed to read the journal: %v", err)
+			return
+		}
+		if len(ops) == 0 {
+			return
+		}
+		if queueExpired(saveDir, ops) {
+			// the server may still take them within its grace period, so they are tried again next time CloudFort starts
+			logger.Warnf("The check-outs of the queued check-ins have expired, giving up for now")
+			return
+		}
+		logger.Infof("%d check-in(s) waiting for the server, trying again in %v", len(ops), delay)
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+		replayJournal(saveDir, config)
+		delay *= 2
+		if delay > QUEUE_RETRY_MAX {
+			delay = QUEUE_RETRY_MAX
+		}
+	}
+}
+
+// whether every queued check-in is for a check-out that has expired
+func queueExpired(saveDir string, ops []PendingOp) bool {
+	for _, op := range ops {
+		token, err := readTokenFile(filepath.Join(saveDir, op.World))
+		if err != nil {
+			continue
+		}
+		expires, err := time.Parse(time.RFC3339, token.Expires)
+		if err != nil || time.Now().Before(expires) {
+			return false
+		}
+	}
+	return true
+}
+
+// compares a checked-out world in the save folder with what its server says about it
+// returns "" if the world is still checked-out to this overseer (or the server can't be asked),
+// or else a description of what became of the check-out
+func reconcileWorld(worldName string, config ClientConfig, serverWorlds map[string]WorldStatus) string {
+	if serverWorlds == nil {
+		return ""
+	}
+	ws, ok := serverWorlds[worldName]
+	if !ok {
+		return fmt.Sprintf("the world no longer exists on server '%s'", config.Profile)
+	}
+	switch ws.Status {
+	case STATUS_CHECKOUT, STATUS_DOWNLOADING:
+		if ws.CurrentOverseer == config.OverseerName {
+			return ""
+		}
+		return fmt.Sprintf("it is now checked-out by %s", ws.CurrentOverseer)
+	case STATUS_AVAILABLE:
+		return fmt.Sprintf("it was checked-in, released or expired, and is available again on server '%s'", config.Profile)
+	default:
+		return fmt.Sprintf("it is %s on server '%s'", ws.Status, config.Profile)
+	}
+}
+
+// turns a world folder that can no longer be checked-in into an ordinary save with a new name, so nothing is lost
+func keepLocalCopy(worldDir string) (string, error) {
+	newDir := fmt.Sprintf("%s-local-%s", worldDir, time.Now().Format("20060102-1504"))
+	err := os.Rename(worldDir, newDir)
+	if err != nil {
+		return worldDir, err
+	}
+	return newDir, os.Remove(filepath.Join(newDir, "token.dftk"))
+}
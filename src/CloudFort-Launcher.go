@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// how CloudFort starts Dwarf Fortress, set by Launcher in CloudFort-config.json
+// by default, it runs Dwarf Fortress.exe, dfhack, df or dwarfort from its own folder with no arguments
+type DFLauncher struct {
+	DFDir      string            // the Dwarf Fortress folder, "" for the CloudFort folder (relative to the CloudFort folder)
+	Command    string            // program to run instead, eg "wine", "./LNP.sh" or a full path (relative to the DF folder)
+	Args       []string          // arguments for the program, eg ["Dwarf Fortress.exe"]
+	Env        map[string]string // environment variables to add, eg {"WINEPREFIX": "/home/urist/.wine-df"}
+	WorkingDir string            // folder to run it in, "" for the DF folder (relative to the DF folder)
+	NoLaunch   bool              // never start DF, for overseers who start it themselves
+}
+
+// the programs that are looked for when there is no Launcher command, in order of preference
+var dfBinNames = []string{"Dwarf Fortress.exe", "dfhack", "df", "dwarfort"}
+
+// the Dwarf Fortress folder: the Launcher DFDir in the config file, or else the CloudFort folder
+// (it is read before the rest of the config is loaded, because the save folder is needed first, eg by restore)
+func dfFolder(cfDir string, configFile string) string {
+	if !fileExists(configFile) {
+		return cfDir
+	}
+	config, err := loadClientConfig(configFile)
+	if err != nil || config.Launcher.DFDir == "" {
+		return cfDir
+	}
+	return resolvePath(cfDir, config.Launcher.DFDir)
+}
+
+// finds Dwarf Fortress in the given folder and checks the launcher settings
+func findLocalDF(dfDir string, saveDir string, launcher DFLauncher) (DFInstall, error) {
+	if fstat, err := os.Stat(dfDir); err != nil || !fstat.IsDir() {
+		return DFInstall{Dir: dfDir}, errors.New(fmt.Sprintf("Invalid Launcher DFDir '%s': %s is not a folder", launcher.DFDir, dfDir))
+	}
+	localDF := DFInstall{
+		Dir:        dfDir,
+		Version:    detectDFVersion(dfDir),
+		SaveFormat: detectSaveFormat(saveDir),
+	}
+	localDF.Layout = detectSaveLayout(dfDir, localDF.Version)
+	for _, binName := range dfBinNames {
+		bp := filepath.Join(dfDir, binName)
+		if fileExists(bp) {
+			localDF.Executable = bp
+			break
+		}
+	}
+	if launcher.NoLaunch {
+		return localDF, nil
+	}
+	if launcher.Command != "" {
+		cmdPath, err := resolveCommand(dfDir, launcher.Command)
+		if err != nil {
+			return localDF, err
+		}
+		localDF.Executable = cmdPath
+	} else if localDF.Executable == "" {
+		return localDF, errors.New(fmt.Sprintf("Dwarf Fortress executable not found in %s! Put CloudFort in your Dwarf Fortress folder, or set the Launcher DFDir or command in CloudFort-config.json", dfDir))
+	}
+	if launcher.WorkingDir != "" {
+		wd := resolvePath(dfDir, launcher.WorkingDir)
+		if fstat, err := os.Stat(wd); err != nil || !fstat.IsDir() {
+			return localDF, errors.New(fmt.Sprintf("Invalid Launcher WorkingDir '%s': %s is not a folder", launcher.WorkingDir, wd))
+		}
+	}
+	for k := range launcher.Env {
+		if k == "" || strings.ContainsRune(k, '=') {
+			return localDF, errors.New(fmt.Sprintf("Invalid Launcher Env variable name '%s'", k))
+		}
+	}
+	return localDF, nil
+}
+
+// finds the Launcher command: a path (relative to the DF folder), a program in the DF folder, or a program on the PATH
+func resolveCommand(dfDir string, command string) (string, error) {
+	if filepath.IsAbs(command) || strings.ContainsAny(command, `/\`) {
+		cmdPath := resolvePath(dfDir, command)
+		if !fileExists(cmdPath) {
+			return cmdPath, errors.New(fmt.Sprintf("Invalid Launcher command '%s': %s does not exist", command, cmdPath))
+		}
+		return cmdPath, nil
+	}
+	if fileExists(filepath.Join(dfDir, command)) {
+		return filepath.Join(dfDir, command), nil
+	}
+	cmdPath, err := exec.LookPath(command)
+	if err != nil {
+		return command, errors.Wrapf(err, "Invalid Launcher command '%s'", command)
+	}
+	return cmdPath, nil
+}
+
+func resolvePath(dir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// the command that starts Dwarf Fortress
+func dfCommand(localDF DFInstall, launcher DFLauncher) *exec.Cmd {
+	dfCmd := exec.Command(localDF.Executable, launcher.Args...)
+	dfCmd.Dir = localDF.Dir
+	if launcher.WorkingDir != "" {
+		dfCmd.Dir = resolvePath(localDF.Dir, launcher.WorkingDir)
+	}
+	if len(launcher.Env) > 0 {
+		dfCmd.Env = os.Environ()
+		for k, v := range launcher.Env {
+			dfCmd.Env = append(dfCmd.Env, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	return dfCmd
+}
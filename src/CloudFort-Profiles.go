@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/gen2brain/dlgs"
+)
+
+// a CloudFort server that the client knows, with the overseer name to use there
+type ServerProfile struct {
+	Name         string
+	HostName     string
+	PortNumber   int64
+	OverseerName string
+	Password     string `json:",omitempty"` // for servers that have a Password
+	TLS          bool   `json:",omitempty"` // connect with TLS, checking the certificate with the system's certificate authorities
+	TLSPin       string `json:",omitempty"` // or connect with TLS and only accept the certificate with this SHA-256 fingerprint (hex)
+}
+
+const ADD_PROFILE = "Add a new server..."
+
+func defaultClientConfig() ClientConfig {
+	return ClientConfig{
+		CloudFortVersion: CloudFortVersion,
+		HostName:         "localhost",
+		PortNumber:       13137,
+		OverseerName:     "",
+		Logging:          defaultLogConfig("CloudFort.log"),
+		AgentPortNumber:  AGENT_PORT,
+		PollInterval:     "1m",
+		BackupsKept:      5,
+		SaveSettleTime:   "10s",
+	}
+}
+
+// reads the config file, switching to the server profile that was used last
+func loadClientConfig(configFile string) (ClientConfig, error) {
+	config := defaultClientConfig()
+	jstr, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(jstr, &config)
+	if err != nil {
+		return config, errors.Wrapf(err, "Failed to parse %s", configFile)
+	}
+	if len(config.Profiles) == 0 {
+		// config files from before server profiles have only the one server
+		config.Profiles = []ServerProfile{{
+			Name:         "default",
+			HostName:     config.HostName,
+			PortNumber:   config.PortNumber,
+			OverseerName: config.OverseerName,
+		}}
+	}
+	if config.Profile == "" {
+		config.Profile = config.Profiles[0].Name
+	}
+	return config.forServer(config.Profile)
+}
+
+// returns a copy of the config that talks to the server of the given profile
+// ("" is the current server, for worlds checked-out before there were server profiles)
+func (config ClientConfig) forServer(profileName string) (ClientConfig, error) {
+	if profileName == "" {
+		profileName = config.Profile
+	}
+	for _, p := range config.Profiles {
+		if p.Name == profileName {
+			config.Profile = p.Name
+			config.HostName = p.HostName
+			config.PortNumber = p.PortNumber
+			config.OverseerName = p.OverseerName
+			config.server = p
+			return config, nil
+		}
+	}
+	return config, errors.New(fmt.Sprintf("There is no server profile named '%s' in CloudFort-config.json", profileName))
+}
+
+func profileSanityCheck(config ClientConfig) error {
+	names := make(map[string]bool)
+	for _, p := range config.Profiles {
+		if p.Name == "" || names[p.Name] {
+			return errors.New(fmt.Sprintf("Server profile names must be unique and not empty ('%s')", p.Name))
+		}
+		names[p.Name] = true
+		if strings.ContainsRune(p.OverseerName, ':') {
+			return errors.New(fmt.Sprintf("Invalid overseer name in server profile '%s': name must not contain ':'", p.Name))
+		}
+		if strings.ContainsAny(p.Password, "\r\n") {
+			return errors.New(fmt.Sprintf("Invalid password in server profile '%s'", p.Name))
+		}
+		if p.TLSPin != "" && len(normalizePin(p.TLSPin)) != 64 {
+			return errors.New(fmt.Sprintf("TLSPin of server profile '%s' must be a SHA-256 fingerprint (64 hex digits)", p.Name))
+		}
+	}
+	return nil
+}
+
+// lets the overseer pick which server to use (if there is more than one), or add a new one
+func pickProfile(configFile string, config ClientConfig) (ClientConfig, error) {
+	labels := make([]string, 0, len(config.Profiles)+1)
+	label2Profile := make(map[string]string)
+	for _, p := range config.Profiles {
+		label := fmt.Sprintf("%s: %s at %s:%d", p.Name, p.OverseerName, p.HostName, p.PortNumber)
+		labels = append(labels, label)
+		label2Profile[label] = p.Name
+	}
+	labels = append(labels, ADD_PROFILE)
+	item, ok, err := dlgs.List("CloudFort Server Selection", "Select a server:", labels)
+	if err != nil {
+		return config, err
+	}
+	if !ok || item == "" {
+		return config, nil
+	}
+	if item == ADD_PROFILE {
+		return addProfile(configFile, config)
+	}
+	config, err = config.forServer(label2Profile[item])
+	if err != nil {
+		return config, err
+	}
+	// remember the choice for next time (and for the agent)
+	return config, saveClientConfig(configFile, config)
+}
+
+// asks for the details of a new server profile and saves it to the config file
+func addProfile(configFile string, config ClientConfig) (ClientConfig, error) {
+	p := askForProfile("", config)
+	config.Profiles = append(config.Profiles, p)
+	config, err := config.forServer(p.Name)
+	if err != nil {
+		return config, err
+	}
+	return config, saveClientConfig(configFile, config)
+}
+
+// asks the overseer for a server address and their name on that server, checking that the server answers
+// (a password or TLS pin has to be added to the config file by hand)
+func askForProfile(name string, config ClientConfig) ServerProfile {
+	p := ServerProfile{Name: name, HostName: "localhost", PortNumber: 13137}
+	for p.Name == "" {
+		logger.Infof("...asking overseer for a name for the server...")
+		name, ok, err := dlgs.Entry("Name the server", "Enter a short name for this server (eg the name of your community):", "")
+		errCheck(err)
+		if !ok {
+			errCheck(errors.New("No server name given"))
+		}
+		name = strings.TrimSpace(name)
+		if _, err := config.forServer(name); err == nil || name == "" || name == ADD_PROFILE {
+			errorPopup("That name is not acceptable (or is already used)! Try again.")
+			continue
+		}
+		p.Name = name
+	}
+	logger.Infof("...asking overseer for their name...")
+	for {
+		name, ok, err := dlgs.Entry("Identify yourself!", "What is your name, overseer?", config.OverseerName)
+		errCheck(err)
+		name = strings.TrimSpace(name)
+		if ok && validateName(name) {
+			p.OverseerName = name
+			break
+		} else {
+			errorPopup("That name is not acceptable! Try again.")
+		}
+	}
+	logger.Infof("...asking overseer for server address...")
+	for {
+		hostStr, ok, err := dlgs.Entry("Cloud Address", "Enter the server address and port number, separated by a : colon. For example, localhost:13137 or 192.168.0.107:13137 or mycloud.net:8013", fmt.Sprintf("%s:%d", p.HostName, p.PortNumber))
+		errCheck(err)
+		sa := strings.SplitN(hostStr, ":", 2)
+		p.HostName = sa[0]
+		if len(sa) == 2 {
+			p.PortNumber, err = strconv.ParseInt(sa[1], 10, 0)
+		} else {
+			err = errors.New("Missing port number")
+		}
+		if err == nil && ok {
+			resp, err := textServer(p, COM_CONCHECK)
+			if err == nil && strings.TrimSpace(resp) == RESP_CONCHECK {
+				// connection good
+				break
+			} else {
+				errorPopup(fmt.Sprintf("Unable to contact server. \n\n%v", err))
+				if !askUser("Edit server address and try again?", "Try again?") {
+					os.Exit(0)
+				}
+			}
+		} else {
+			errorPopup("That address is not acceptable! Try again.")
+		}
+	}
+	return p
+}
+
+// connects to a server, with TLS if the profile says so, and gives the password (if any) ahead of the request
+func dialServer(p ServerProfile) (net.Conn, error) {
+	hostStr := net.JoinHostPort(p.HostName, strconv.FormatInt(p.PortNumber, 10))
+	var connection net.Conn
+	var err error
+	if p.TLSPin != "" {
+		pin := normalizePin(p.TLSPin)
+		connection, err = tls.Dial("tcp", hostStr, &tls.Config{
+			// the certificate is checked against the pin instead of the certificate authorities, so that self-signed certificates work
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 || certFingerprint(rawCerts[0]) != pin {
+					return errors.New(fmt.Sprintf("The TLS certificate of server %s does not match the TLSPin of server profile '%s'", hostStr, p.Name))
+				}
+				return nil
+			},
+		})
+	} else if p.TLS {
+		connection, err = tls.Dial("tcp", hostStr, &tls.Config{ServerName: p.HostName})
+	} else {
+		connection, err = net.Dial("tcp", hostStr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.Password != "" {
+		_, err = connection.Write(strToUtf8(fmt.Sprintf("%s:%s\n", COM_AUTH, p.Password)))
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+	}
+	return connection, nil
+}
+
+// fingerprints can be written in upper or lower case, with or without colons
+func normalizePin(pin string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(pin), ":", ""))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// checkpoints are saves uploaded by the holder of a check-out while they play, without checking the world in,
+// so that a long turn is not lost if their computer dies before the check-in
+// only the latest checkpoint of each world is kept, in the checkpoints folder of the save folder
+
+const (
+	EXPIRED_REVERT     = "revert"
+	EXPIRED_CHECKPOINT = "checkpoint"
+)
+
+// saved next to a checkpoint as <world>.json
+type Checkpoint struct {
+	Overseer   string
+	Time       string
+	Revision   string // hash of the uploaded zip file
+	MagicRunes string // of the check-out the checkpoint belongs to
+}
+
+func checkpointPaths(worldName string, config ServerConfig) (string, string) {
+	dir := filepath.Join(config.WorldSaveFolder, "checkpoints")
+	return filepath.Join(dir, fmt.Sprintf("%s.zip", worldName)), filepath.Join(dir, fmt.Sprintf("%s.json", worldName))
+}
+
+// keeps an uploaded save as the latest checkpoint of a checked-out world (the world stays checked-out)
+func acceptCheckpoint(worldName string, overseer string, magicRunes string, uploadPath string, hash string, config ServerConfig) error {
+	err := authorizeCheckIn(worldName, overseer, magicRunes)
+	if err != nil {
+		return err
+	}
+	tmpHash, err := hashFile(uploadPath)
+	if err != nil {
+		return err
+	}
+	if hash != tmpHash {
+		metrics.recordHashMismatch()
+		return errors.New(fmt.Sprintf("File hash mis-match"))
+	}
+	wconf, err := loadWorldConfig(worldName, config)
+	if err != nil {
+		return err
+	}
+	report, _ := validateSaveZip(uploadPath, sizeLimitBytes(wconf.WorldSizeLimitMB), wconf.SaveFiles)
+	if !report.IsValid() {
+		return errors.New(fmt.Sprintf("Uploaded save is not valid: %s", strings.Join(report.Problems, "; ")))
+	}
+	zipPath, infoPath := checkpointPaths(worldName, config)
+	_, err = ensureDir(filepath.Dir(zipPath))
+	if err != nil {
+		return err
+	}
+	// copy next to the old checkpoint first, so that it is only replaced by a complete one
+	err = copyFile(uploadPath, zipPath+".temp")
+	if err != nil {
+		return err
+	}
+	err = os.Rename(zipPath+".temp", zipPath)
+	if err != nil {
+		return err
+	}
+	cp := Checkpoint{Overseer: overseer, Time: time.Now().Format(time.RFC3339), Revision: hash, MagicRunes: magicRunes}
+	jstr, _ := json.MarshalIndent(cp, "", "\t")
+	return ioutil.WriteFile(infoPath, jstr, 0664)
+}
+
+// returns the latest checkpoint of a world, if there is one
+func loadCheckpoint(worldName string, config ServerConfig) (Checkpoint, bool) {
+	var cp Checkpoint
+	zipPath, infoPath := checkpointPaths(worldName, config)
+	if !fileExists(zipPath) || !fileExists(infoPath) {
+		return cp, false
+	}
+	jstr, err := ioutil.ReadFile(infoPath)
+	if err != nil {
+		warn(err)
+		return cp, false
+	}
+	err = json.Unmarshal(jstr, &cp)
+	if err != nil {
+		warn(errors.Wrapf(err, "Failed to parse %s", infoPath))
+		return cp, false
+	}
+	return cp, true
+}
+
+func removeCheckpoint(worldName string, config ServerConfig) error {
+	zipPath, infoPath := checkpointPaths(worldName, config)
+	for _, f := range []string{zipPath, infoPath} {
+		if fileExists(f) {
+			err := os.Remove(f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// called when a check-out expires: if the world's ExpirationAction is "checkpoint" and the check-out has a checkpoint,
+// it replaces the world's save (returning the checkpoint's revision), otherwise the world is simply reverted
+func expireToCheckpoint(worldName string, token LockToken, config ServerConfig) (string, error) {
+	wconf, err := loadWorldConfig(worldName, config)
+	if err != nil || wconf.ExpirationAction != EXPIRED_CHECKPOINT {
+		return "", err
+	}
+	cp, ok := loadCheckpoint(worldName, config)
+	if !ok || cp.MagicRunes != token.MagicRunes {
+		return "", nil
+	}
+	zipPath, _ := checkpointPaths(worldName, config)
+	err = replaceSave(worldName, zipPath, config)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to restore the checkpoint of world %s", worldName)
+	}
+	logger.Infof("World %s was set to its checkpoint from %s by %s", worldName, cp.Time, cp.Overseer)
+	return cp.Revision, nil
+}
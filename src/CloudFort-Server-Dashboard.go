@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// one row of the world table on the dashboard
+type dashboardWorld struct {
+	Name          string
+	Status        WorldStatus
+	TimeRemaining string
+	Revisions     []string // only filled-in if spectators may download them
+}
+
+type dashboardPage struct {
+	Worlds   []dashboardWorld
+	History  []HistoryEntry
+	Updated  string
+	Password string // passed on to the revision links, if the server has one
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="60">
+<title>CloudFort</title>
+<style>
+body { font-family: sans-serif; margin: 2em; background: #1e1e1e; color: #ddd; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #555; padding: 0.3em 0.7em; text-align: left; vertical-align: top; }
+th { background: #333; }
+a { color: #8cf; }
+.available { color: #7d7; }
+.checked-out, .downloading { color: #fc6; }
+.invalid { color: #f77; }
+.small { font-size: 0.85em; color: #aaa; }
+</style>
+</head>
+<body>
+<h1>CloudFort</h1>
+<h2>Worlds</h2>
+<table>
+<tr><th>World</th><th>Status</th><th>Overseer</th><th>Time remaining</th><th>Queue</th><th>Save</th><th>Revisions</th></tr>
+{{range .Worlds}}<tr>
+<td><b>{{.Name}}</b>{{if .Status.Description}}<br><span class="small">{{.Status.Description}}</span>{{end}}</td>
+<td class="{{.Status.Status}}">{{.Status.Status}}{{if .Status.Problem}}<br><span class="small">{{.Status.Problem}}</span>{{end}}</td>
+<td>{{.Status.CurrentOverseer}}</td>
+<td>{{.TimeRemaining}}</td>
+<td>{{range $i, $o := .Status.Queue}}{{if $i}}, {{end}}{{$o}}{{end}}{{if .Status.ReservedFor}}<br><span class="small">reserved for {{.Status.ReservedFor}} until {{.Status.ReservedUntil}}</span>{{end}}</td>
+<td class="small">{{if .Status.Info}}{{.Status.Info}}{{end}}{{if .Status.DFVersion}}<br>DF {{.Status.DFVersion}}{{end}}</td>
+<td class="small">{{$world := .Name}}{{range .Revisions}}<a href="/revisions/{{$world}}/{{.}}.zip{{if $.Password}}?password={{$.Password}}{{end}}">{{.}}</a><br>{{end}}</td>
+</tr>
+{{end}}</table>
+<h2>Recent events</h2>
+<table>
+<tr><th>Time</th><th>World</th><th>Overseer</th><th>Event</th></tr>
+{{range .History}}<tr><td>{{.Time}}</td><td>{{.World}}</td><td>{{.Overseer}}</td><td>{{.Event}}</td></tr>
+{{end}}</table>
+<p class="small">Updated {{.Updated}}</p>
+</body>
+</html>
+`))
+
+// adds the read-only web dashboard (and spectator downloads) to the HTTP server
+func addDashboardHandlers(mux *http.ServeMux, config ServerConfig) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		if !httpAuthorized(w, r, config) {
+			return
+		}
+		page, err := buildDashboard(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			warn(err)
+			return
+		}
+		if config.Password != "" {
+			page.Password = httpParam(r, "password")
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = dashboardTemplate.Execute(w, page)
+		warn(err)
+	})
+	mux.HandleFunc("/revisions/", func(w http.ResponseWriter, r *http.Request) {
+		if !httpAuthorized(w, r, config) {
+			return
+		}
+		sp := strings.Split(strings.TrimPrefix(r.URL.Path, "/revisions/"), "/")
+		if len(sp) != 2 || !strings.HasSuffix(sp[1], ".zip") {
+			http.NotFound(w, r)
+			return
+		}
+		worldName := sp[0]
+		revision := strings.TrimSuffix(sp[1], ".zip")
+		if _, exists := getStatus(worldName); !exists {
+			http.NotFound(w, r)
+			return
+		}
+		wconf, err := loadWorldConfig(worldName, config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !*wconf.SpectatorDownloads {
+			http.Error(w, fmt.Sprintf("Downloads of world %s are not allowed", worldName), http.StatusForbidden)
+			return
+		}
+		revPath, err := revisionPath(worldName, revision, config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		logger.Infof("HTTP client %s downloaded revision %s of world %s", r.RemoteAddr, revision, worldName)
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s.zip\"", worldName, revision))
+		http.ServeFile(w, r, revPath)
+	})
+}
+
+func buildDashboard(config ServerConfig) (dashboardPage, error) {
+	var page dashboardPage
+	listing := worldListing(config)
+	names := make([]string, 0, len(listing))
+	for name := range listing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ws := listing[name]
+		dw := dashboardWorld{Name: name, Status: ws}
+		if ws.Status == STATUS_CHECKOUT || ws.Status == STATUS_DOWNLOADING {
+			dw.TimeRemaining = timeRemaining(ws.Expires)
+		}
+		wconf, err := loadWorldConfig(name, config)
+		if err == nil && *wconf.SpectatorDownloads {
+			dw.Revisions, err = listRevisions(name, config)
+			warn(err)
+		}
+		page.Worlds = append(page.Worlds, dw)
+	}
+	history, err := readHistory("", config)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return page, err
+	}
+	// most recent first
+	for i := len(history) - 1; i >= 0 && len(page.History) < 25; i-- {
+		page.History = append(page.History, history[i])
+	}
+	page.Updated = time.Now().Format(time.RFC1123)
+	return page, nil
+}
+
+// describes how long until a check-out expires, eg "3h25m" or "overdue by 10m"
+func timeRemaining(expires string) string {
+	expTime, err := time.Parse(time.RFC3339, expires)
+	if err != nil {
+		return ""
+	}
+	remaining := time.Until(expTime).Round(time.Minute)
+	if remaining < 0 {
+		return fmt.Sprintf("overdue by %s", strings.TrimSuffix((-remaining).String(), "0s"))
+	}
+	return strings.TrimSuffix(remaining.String(), "0s")
+}
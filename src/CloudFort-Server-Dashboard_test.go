@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a dashboard on a server with a password, and one world that has a revision spectators may download
+func dashboardTestServer(t *testing.T) *httptest.Server {
+	config := ServerConfig{
+		WorldSaveFolder:    t.TempDir(),
+		Password:           "hunter2",
+		SpectatorDownloads: true,
+	}
+	revDir := filepath.Join(config.WorldSaveFolder, "revisions", "test_world")
+	err := os.MkdirAll(revDir, 0775)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(revDir, "20240101-120000.zip"), []byte("PK"), 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statusLock.Lock()
+	statusMap = map[string]LockToken{"test_world": {Status: STATUS_AVAILABLE}}
+	statusLock.Unlock()
+	mux := http.NewServeMux()
+	addDashboardHandlers(mux, config)
+	addMetricsHandler(mux, config)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDashboardNeedsPassword(t *testing.T) {
+	srv := dashboardTestServer(t)
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/", http.StatusUnauthorized},
+		{"/?password=wrong", http.StatusUnauthorized},
+		{"/metrics", http.StatusUnauthorized},
+		{"/revisions/test_world/20240101-120000.zip", http.StatusUnauthorized},
+		{"/revisions/test_world/20240101-120000.zip?password=wrong", http.StatusUnauthorized},
+		{"/revisions/test_world/20240101-120000.zip?password=hunter2", http.StatusOK},
+		{"/metrics?password=hunter2", http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("GET %s: status %d, want %d", tt.path, resp.StatusCode, tt.wantStatus)
+		}
+	}
+}
+
+func TestDashboardPasswordHeader(t *testing.T) {
+	srv := dashboardTestServer(t)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/revisions/test_world/20240101-120000.zip", nil)
+	req.Header.Set("X-CloudFort-Password", "hunter2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("download with the password header: status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
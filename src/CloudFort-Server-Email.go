@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// settings for sending email reminders to overseers (their addresses are in overseers.json in the server's state folder)
+type EmailConfig struct {
+	SMTPHost     string // the SMTP relay, empty to turn off email
+	SMTPPort     int
+	Username     string // for SMTP authentication, empty for none
+	Password     string
+	From         string
+	ReminderTime string                   // how long before a check-out expires to remind the overseer
+	Templates    map[string]EmailTemplate // subject and text of each kind of email, as Go templates using the emailData fields
+}
+
+type EmailTemplate struct {
+	Subject string
+	Body    string
+}
+
+// an overseer's entry in overseers.json
+type OverseerContact struct {
+	Email  string
+	OptOut []string // kinds of email the overseer does not want ("turn", "expiring", "expired"), or "all"
+}
+
+const (
+	EMAIL_TURN     = "turn"
+	EMAIL_EXPIRING = "expiring"
+	EMAIL_EXPIRED  = "expired"
+)
+
+var defaultEmailTemplates = map[string]EmailTemplate{
+	EMAIL_TURN: {
+		Subject: "CloudFort: your turn to play {{.World}}",
+		Body:    "Hello {{.Overseer}},\n\nIt is now your turn to play {{.World}}. It is reserved for you until {{.Until}}, so start CloudFort and check it out before then.\n",
+	},
+	EMAIL_EXPIRING: {
+		Subject: "CloudFort: {{.World}} is due back soon",
+		Body:    "Hello {{.Overseer}},\n\nYour check-out of {{.World}} expires at {{.Until}}. Please save your game and close Dwarf Fortress so that CloudFort can check it in, or ask for more time.\n",
+	},
+	EMAIL_EXPIRED: {
+		Subject: "CloudFort: your check-out of {{.World}} expired",
+		Body:    "Hello {{.Overseer}},\n\nYour check-out of {{.World}} expired, so {{if .Checkpoint}}the world was set to your last checkpoint and anything you played after it is lost{{else}}the world was reverted to its last check-in and anything you played since then is lost{{end}}.\n",
+	},
+}
+
+// what the email templates can use
+type emailData struct {
+	Overseer   string
+	World      string
+	Until      string // reservation or expiration time
+	Checkpoint bool   // for expired check-outs: whether the world was set to a checkpoint instead of reverted
+}
+
+var remindedLock sync.Mutex
+var reminded = make(map[string]string) // world -> expiration time that the holder was already reminded about
+
+func emailSanityCheck(c ServerConfig) error {
+	if c.Email.SMTPHost == "" {
+		return nil
+	}
+	if c.Email.From == "" {
+		return errors.New("Email.From must be set to send email")
+	}
+	_, err := time.ParseDuration(c.Email.ReminderTime)
+	if err != nil {
+		return errors.Wrap(err, "Invalid Email.ReminderTime")
+	}
+	for kind, t := range c.Email.Templates {
+		if _, ok := defaultEmailTemplates[kind]; !ok {
+			return errors.New(fmt.Sprintf("Unknown kind of email '%s' in Email.Templates", kind))
+		}
+		for _, text := range []string{t.Subject, t.Body} {
+			_, err := template.New(kind).Parse(text)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid %s email template", kind)
+			}
+		}
+	}
+	return nil
+}
+
+// sends emails for events from the event log (new turns and expired check-outs)
+func notifyByEmail(ev *Event, config ServerConfig) {
+	if config.Email.SMTPHost == "" || ev.Result != RESULT_OK {
+		return
+	}
+	switch ev.Type {
+	case EVENT_TURN:
+		_, until := reservation(ev.World)
+		go sendReminder(EMAIL_TURN, emailData{Overseer: ev.Overseer, World: ev.World, Until: until}, config)
+	case EVENT_EXPIRE:
+		go sendReminder(EMAIL_EXPIRED, emailData{Overseer: ev.Overseer, World: ev.World, Checkpoint: ev.Revision != ""}, config)
+	}
+}
+
+// called by expirationChecker for each checked-out world: reminds the overseer once when their check-out is about to expire
+// (and again after an extension)
+func remindIfExpiring(worldName string, token LockToken, expTime time.Time, tnow time.Time, config ServerConfig) {
+	if config.Email.SMTPHost == "" {
+		return
+	}
+	rt, _ := time.ParseDuration(config.Email.ReminderTime)
+	if tnow.Add(rt).Before(expTime) {
+		return
+	}
+	remindedLock.Lock()
+	if reminded[worldName] == token.Expires {
+		remindedLock.Unlock()
+		return
+	}
+	reminded[worldName] = token.Expires
+	remindedLock.Unlock()
+	go sendReminder(EMAIL_EXPIRING, emailData{Overseer: token.CurrentOverseer, World: worldName, Until: token.Expires}, config)
+}
+
+// called by checkIn when a world is checked-in, released or expired, so that its next check-out gets a reminder again
+func forgetReminder(worldName string) {
+	remindedLock.Lock()
+	delete(reminded, worldName)
+	remindedLock.Unlock()
+}
+
+func sendReminder(kind string, data emailData, config ServerConfig) {
+	contact, err := overseerContact(data.Overseer, config)
+	if err != nil {
+		warn(err)
+		return
+	}
+	if contact.Email == "" || containsString(contact.OptOut, kind) || containsString(contact.OptOut, "all") {
+		return
+	}
+	if t, err := time.Parse(time.RFC3339, data.Until); err == nil {
+		data.Until = t.Local().Format("Mon Jan 2 15:04 MST")
+	}
+	err = sendEmail(contact.Email, kind, data, config)
+	if err != nil {
+		warn(errors.Wrapf(err, "Failed to send %s email to overseer %s", kind, data.Overseer))
+		return
+	}
+	logger.Infof("Sent %s email about world %s to overseer %s", kind, data.World, data.Overseer)
+}
+
+// reads an overseer's email settings from overseers.json
+func overseerContact(overseer string, config ServerConfig) (OverseerContact, error) {
+	var contacts map[string]OverseerContact
+	contactsFile := stateFile("overseers.json", config)
+	if !fileExists(contactsFile) {
+		return OverseerContact{}, nil
+	}
+	jstr, err := ioutil.ReadFile(contactsFile)
+	if err != nil {
+		return OverseerContact{}, err
+	}
+	err = json.Unmarshal(jstr, &contacts)
+	if err != nil {
+		return OverseerContact{}, errors.Wrapf(err, "Failed to parse %s", contactsFile)
+	}
+	return contacts[overseer], nil
+}
+
+func sendEmail(to string, kind string, data emailData, config ServerConfig) error {
+	t, ok := config.Email.Templates[kind]
+	if !ok {
+		t = defaultEmailTemplates[kind]
+	}
+	var subject, body bytes.Buffer
+	tmpl, err := template.New(kind).Parse(t.Subject)
+	if err != nil {
+		return err
+	}
+	err = tmpl.Execute(&subject, data)
+	if err != nil {
+		return err
+	}
+	tmpl, err = template.New(kind).Parse(t.Body)
+	if err != nil {
+		return err
+	}
+	err = tmpl.Execute(&body, data)
+	if err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		config.Email.From, to, strings.TrimSpace(subject.String()), time.Now().Format(time.RFC1123Z),
+		strings.ReplaceAll(body.String(), "\n", "\r\n"))
+	var auth smtp.Auth
+	if config.Email.Username != "" {
+		auth = smtp.PlainAuth("", config.Email.Username, config.Email.Password, config.Email.SMTPHost)
+	}
+	addr := net.JoinHostPort(config.Email.SMTPHost, strconv.Itoa(config.Email.SMTPPort))
+	return smtp.SendMail(addr, auth, config.Email.From, []string{to}, []byte(msg))
+}
+
+// the "email-test" subcommand: sends an example reminder to an address right away
+func testEmail(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: CloudFort-Server email-test <address>")
+	}
+	config := readConfig()
+	if config.Email.SMTPHost == "" {
+		return errors.New("There is no Email.SMTPHost in server-config.json")
+	}
+	data := emailData{Overseer: "Urist", World: "test_world", Until: time.Now().Add(time.Hour).Format("Mon Jan 2 15:04 MST")}
+	err := sendEmail(args[0], EMAIL_TURN, data, config)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sent an example email to %s\n", args[0])
+	return nil
+}
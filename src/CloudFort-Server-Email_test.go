@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a mail sent to the fake SMTP server
+type fakeMail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// starts an SMTP server on localhost that accepts every mail and passes it on to the returned channel
+func fakeSMTPServer(t *testing.T, host string) (string, int, chan fakeMail) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	mails := make(chan fakeMail, 10)
+	go func() {
+		for {
+			conx, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conx, mails)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, mails
+}
+
+func serveFakeSMTP(conx net.Conn, mails chan fakeMail) {
+	defer conx.Close()
+	r := bufio.NewReader(conx)
+	reply := func(s string) { conx.Write([]byte(s + "\r\n")) }
+	reply("220 localhost fake SMTP")
+	var mail fakeMail
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			mail = fakeMail{From: strings.Trim(line[len("MAIL FROM:"):], "<> ")}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			mail.To = append(mail.To, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 end with <CRLF>.<CRLF>")
+			var data strings.Builder
+			for {
+				dl, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dl == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dl, "."))
+			}
+			mail.Data = data.String()
+			mails <- mail
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func emailTestConfig(t *testing.T, contacts map[string]OverseerContact) (ServerConfig, chan fakeMail) {
+	return emailTestConfigOn(t, "127.0.0.1", contacts)
+}
+
+func emailTestConfigOn(t *testing.T, smtpHost string, contacts map[string]OverseerContact) (ServerConfig, chan fakeMail) {
+	host, port, mails := fakeSMTPServer(t, smtpHost)
+	config := ServerConfig{
+		WorldSaveFolder: t.TempDir(),
+		Email: EmailConfig{
+			SMTPHost:     host,
+			SMTPPort:     port,
+			From:         "cloudfort@example.com",
+			ReminderTime: "1h",
+		},
+	}
+	jstr, _ := json.Marshal(contacts)
+	_, err := ensureDir(stateDir(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(stateFile("overseers.json", config), jstr, 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remindedLock.Lock()
+	reminded = make(map[string]string)
+	remindedLock.Unlock()
+	return config, mails
+}
+
+func waitForMail(t *testing.T, mails chan fakeMail) fakeMail {
+	select {
+	case m := <-mails:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was sent")
+	}
+	return fakeMail{}
+}
+
+func expectNoMail(t *testing.T, mails chan fakeMail) {
+	select {
+	case m := <-mails:
+		t.Errorf("unexpected email sent: %+v", m)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func checkMail(t *testing.T, m fakeMail, to string, subject string, bodyText string) {
+	if len(m.To) != 1 || m.To[0] != to {
+		t.Errorf("email sent to %v, want %s", m.To, to)
+	}
+	if m.From != "cloudfort@example.com" {
+		t.Errorf("email sent from %s", m.From)
+	}
+	if !strings.Contains(m.Data, "\r\nSubject: "+subject+"\r\n") {
+		t.Errorf("email does not have the subject %q:\n%s", subject, m.Data)
+	}
+	if !strings.Contains(m.Data, bodyText) {
+		t.Errorf("email does not contain %q:\n%s", bodyText, m.Data)
+	}
+}
+
+func TestTurnEmail(t *testing.T) {
+	config, mails := emailTestConfig(t, map[string]OverseerContact{"Urist": {Email: "urist@example.com"}})
+	until := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	statusLock.Lock()
+	queueMap = map[string]TurnQueue{"test_world": {Overseers: []string{"Urist"}, ReservedUntil: until.Format(time.RFC3339)}}
+	statusLock.Unlock()
+
+	notifyByEmail(&Event{Type: EVENT_TURN, World: "test_world", Overseer: "Urist", Result: RESULT_OK}, config)
+	m := waitForMail(t, mails)
+	checkMail(t, m, "urist@example.com", "CloudFort: your turn to play test_world",
+		"It is now your turn to play test_world. It is reserved for you until "+until.Local().Format("Mon Jan 2 15:04 MST"))
+}
+
+func TestExpiringReminder(t *testing.T) {
+	config, mails := emailTestConfig(t, map[string]OverseerContact{"Urist": {Email: "urist@example.com"}})
+	tnow := time.Now()
+	expires := tnow.Add(30 * time.Minute)
+	token := LockToken{CurrentOverseer: "Urist", Expires: expires.Format(time.RFC3339)}
+
+	remindIfExpiring("test_world", token, expires, tnow, config)
+	m := waitForMail(t, mails)
+	checkMail(t, m, "urist@example.com", "CloudFort: test_world is due back soon",
+		"Your check-out of test_world expires at "+expires.Local().Format("Mon Jan 2 15:04 MST"))
+
+	// only once for each expiration time
+	remindIfExpiring("test_world", token, expires, tnow.Add(time.Minute), config)
+	expectNoMail(t, mails)
+
+	// and again after an extension
+	expires = expires.Add(time.Hour)
+	token.Expires = expires.Format(time.RFC3339)
+	remindIfExpiring("test_world", token, expires, tnow, config)
+	expectNoMail(t, mails)
+	remindIfExpiring("test_world", token, expires, tnow.Add(time.Hour), config)
+	waitForMail(t, mails)
+
+	// and nothing is kept after the check-in
+	forgetReminder("test_world")
+	remindedLock.Lock()
+	n := len(reminded)
+	remindedLock.Unlock()
+	if n != 0 {
+		t.Errorf("%d reminders remembered after the check-in, want 0", n)
+	}
+}
+
+func TestEmailOptOut(t *testing.T) {
+	config, mails := emailTestConfig(t, map[string]OverseerContact{
+		"Urist": {Email: "urist@example.com", OptOut: []string{EMAIL_EXPIRING}},
+		"Kogan": {Email: "kogan@example.com", OptOut: []string{"all"}},
+	})
+	expires := time.Now().Add(10 * time.Minute)
+	remindIfExpiring("test_world", LockToken{CurrentOverseer: "Urist", Expires: expires.Format(time.RFC3339)}, expires, time.Now(), config)
+	remindIfExpiring("other_world", LockToken{CurrentOverseer: "Kogan", Expires: expires.Format(time.RFC3339)}, expires, time.Now(), config)
+	notifyByEmail(&Event{Type: EVENT_EXPIRE, World: "test_world", Overseer: "Kogan", Result: RESULT_OK}, config)
+	expectNoMail(t, mails)
+
+	// (Urist still gets the other kinds)
+	notifyByEmail(&Event{Type: EVENT_EXPIRE, World: "test_world", Overseer: "Urist", Result: RESULT_OK, Revision: "abc"}, config)
+	m := waitForMail(t, mails)
+	checkMail(t, m, "urist@example.com", "CloudFort: your check-out of test_world expired", "the world was set to your last checkpoint")
+}
+
+func TestEmailNeedsSMTPHost(t *testing.T) {
+	config, mails := emailTestConfig(t, map[string]OverseerContact{"Urist": {Email: "urist@example.com"}})
+	config.Email.SMTPHost = ""
+	notifyByEmail(&Event{Type: EVENT_EXPIRE, World: "test_world", Overseer: "Urist", Result: RESULT_OK}, config)
+	expectNoMail(t, mails)
+}
+
+func TestEmailIPv6Host(t *testing.T) {
+	if ln, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("no IPv6 on localhost")
+	} else {
+		ln.Close()
+	}
+	config, mails := emailTestConfigOn(t, "::1", map[string]OverseerContact{"Urist": {Email: "urist@example.com"}})
+	notifyByEmail(&Event{Type: EVENT_EXPIRE, World: "test_world", Overseer: "Urist", Result: RESULT_OK}, config)
+	m := waitForMail(t, mails)
+	checkMail(t, m, "urist@example.com", "CloudFort: your check-out of test_world expired", "test_world")
+}
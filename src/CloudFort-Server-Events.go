@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the structured event log, events.jsonl in the save folder, has one JSON object per line
+// (history.csv is still written alongside it for backwards compatibility)
+
+const (
+	EVENT_CHECKOUT    = "checkout"
+	EVENT_CHECKIN     = "checkin"
+	EVENT_RELEASE     = "release"
+	EVENT_EXPIRE      = "expire"
+	EVENT_ABORT       = "abort" // the download of a check-out timed out
+	EVENT_EXTEND      = "extend"
+	EVENT_RESERVE     = "reserve"
+	EVENT_UNRESERVE   = "unreserve"
+	EVENT_TURN        = "turn"
+	EVENT_MISSED_TURN = "missed-turn"
+	EVENT_PEEK        = "peek"
+	EVENT_INVALID     = "invalid"
+	EVENT_QUARANTINE  = "quarantine"
+	EVENT_CHECKPOINT  = "checkpoint"
+)
+
+const RESULT_OK = "ok"
+
+type Event struct {
+	Time     string
+	Type     string
+	World    string
+	Overseer string  `json:",omitempty"`
+	Revision string  `json:",omitempty"` // hash of the zip file that was sent or received
+	Client   string  `json:",omitempty"` // network address of the client, empty for events caused by the server itself
+	Bytes    int64   `json:",omitempty"`
+	Duration float64 `json:",omitempty"` // seconds
+	Result   string  // "ok" or the error message
+	start    time.Time
+}
+
+var eventLock sync.Mutex
+
+// starts timing an event, which is written to the log by logEvent
+func newEvent(eventType string, worldName string, overseer string, client string) *Event {
+	return &Event{
+		Type:     eventType,
+		World:    worldName,
+		Overseer: overseer,
+		Client:   client,
+		start:    time.Now(),
+	}
+}
+
+// records the error that ended an event (the first error is kept)
+func (ev *Event) failed(err error) {
+	if err != nil && ev.Result == "" {
+		ev.Result = err.Error()
+	}
+}
+
+// appends an event to events.jsonl
+func logEvent(ev *Event, config ServerConfig) {
+	tnow := time.Now()
+	ev.Time = tnow.Format(time.RFC3339)
+	if !ev.start.IsZero() {
+		ev.Duration = tnow.Sub(ev.start).Seconds()
+	}
+	if ev.Result == "" {
+		ev.Result = RESULT_OK
+	}
+	metrics.recordEvent(ev)
+	notifyWebhooks(ev, config)
+	notifyByEmail(ev, config)
+	jstr, err := json.Marshal(ev)
+	if err != nil {
+		warn(err)
+		return
+	}
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	eventFile := filepath.Join(config.WorldSaveFolder, "events.jsonl")
+	file, err := os.OpenFile(eventFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		warn(err)
+		return
+	}
+	defer file.Close()
+	_, err = file.Write(append(jstr, '\n'))
+	warn(err)
+}
+
+// the "query" subcommand: prints the logged events that match the given filters
+func queryEvents(args []string) error {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	world := flags.String("world", "", "only show events of this world")
+	overseer := flags.String("overseer", "", "only show events of this overseer")
+	eventType := flags.String("type", "", "only show events of this type (eg checkout, checkin, expire)")
+	sinceStr := flags.String("since", "", "only show events at or after this time: a date (2006-01-02), a time (2006-01-02T15:04:05Z) or a duration before now (eg 48h)")
+	untilStr := flags.String("until", "", "only show events before this time (same formats as -since)")
+	asJSON := flags.Bool("json", false, "print the matching events as JSON lines")
+	flags.Parse(args)
+	since, err := parseQueryTime(*sinceStr)
+	if err != nil {
+		return err
+	}
+	until, err := parseQueryTime(*untilStr)
+	if err != nil {
+		return err
+	}
+	config := readConfig()
+	eventFile := filepath.Join(config.WorldSaveFolder, "events.jsonl")
+	file, err := os.Open(eventFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var ev Event
+		if json.Unmarshal(scanner.Bytes(), &ev) != nil {
+			continue
+		}
+		if (*world != "" && ev.World != *world) || (*overseer != "" && ev.Overseer != *overseer) || (*eventType != "" && ev.Type != *eventType) {
+			continue
+		}
+		evTime, err := time.Parse(time.RFC3339, ev.Time)
+		if err != nil || (!since.IsZero() && evTime.Before(since)) || (!until.IsZero() && !evTime.Before(until)) {
+			continue
+		}
+		if *asJSON {
+			fmt.Println(scanner.Text())
+			continue
+		}
+		line := fmt.Sprintf("%s  %-11s  %-16s  %-16s  %s", ev.Time, ev.Type, ev.World, ev.Overseer, ev.Result)
+		if ev.Bytes > 0 {
+			line = fmt.Sprintf("%s  %d bytes", line, ev.Bytes)
+		}
+		if ev.Duration > 0 {
+			line = fmt.Sprintf("%s  %.1fs", line, ev.Duration)
+		}
+		if ev.Client != "" {
+			line = fmt.Sprintf("%s  from %s", line, ev.Client)
+		}
+		fmt.Println(line)
+	}
+	return scanner.Err()
+}
+
+// parses the -since and -until options of the query subcommand
+func parseQueryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New(fmt.Sprintf("Invalid time '%s'", s))
+}
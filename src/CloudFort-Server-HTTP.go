@@ -0,0 +1,469 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// one row of history.csv
+type HistoryEntry struct {
+	Time     string
+	World    string
+	Overseer string
+	Event    string
+}
+
+// response body for GET /api/worlds/{world}
+type WorldDetail struct {
+	Name     string
+	Status   WorldStatus
+	Settings WorldConfig
+}
+
+type httpErrorResponse struct {
+	Error string
+}
+
+// serves the HTTP API and web dashboard (and blocks forever)
+// the API is an alternative to the TCP protocol for other tools
+func serveHTTP(config ServerConfig) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(openAPIDescription))
+	})
+	mux.HandleFunc("/api/worlds", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, errors.New("Only GET is allowed"))
+			return
+		}
+		if !httpAuthorized(w, r, config) {
+			return
+		}
+		writeJSON(w, worldListing(config))
+	})
+	mux.HandleFunc("/api/worlds/", func(w http.ResponseWriter, r *http.Request) {
+		handleWorldRequest(w, r, config)
+	})
+	addDashboardHandlers(mux, config)
+	addMetricsHandler(mux, config)
+	hostStr := net.JoinHostPort(config.HostBindAddress, strconv.FormatInt(config.HTTPPortNumber, 10))
+	logger.Infof("Starting HTTP API, listening to port %s...", hostStr)
+	if config.TLSCertFile != "" {
+		fail(http.ListenAndServeTLS(hostStr, config.TLSCertFile, config.TLSKeyFile, mux))
+	}
+	fail(http.ListenAndServe(hostStr, mux))
+}
+
+// checks the server password (if there is one) of an API request, replying with an error if it is wrong
+func httpAuthorized(w http.ResponseWriter, r *http.Request, config ServerConfig) bool {
+	if config.Password == "" || subtle.ConstantTimeCompare([]byte(httpParam(r, "password")), []byte(config.Password)) == 1 {
+		return true
+	}
+	httpError(w, http.StatusUnauthorized, errors.New("Missing or wrong server password"))
+	return false
+}
+
+// handles /api/worlds/{world} and /api/worlds/{world}/{action}
+func handleWorldRequest(w http.ResponseWriter, r *http.Request, config ServerConfig) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/worlds/"), "/")
+	sp := strings.SplitN(path, "/", 2)
+	worldName := sp[0]
+	action := ""
+	if len(sp) > 1 {
+		action = sp[1]
+	}
+	if !httpAuthorized(w, r, config) {
+		return
+	}
+	if _, exists := getStatus(worldName); !exists {
+		httpError(w, http.StatusNotFound, errors.New(fmt.Sprintf("No world named '%s'", worldName)))
+		return
+	}
+	rlog := logger.withRequestID(nextRequestID())
+	rlog.Infof("HTTP client %s requested %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+	wantMethod := http.MethodPost
+	if action == "" || action == "history" {
+		wantMethod = http.MethodGet
+	}
+	if r.Method != wantMethod {
+		httpError(w, http.StatusMethodNotAllowed, errors.New(fmt.Sprintf("Only %s is allowed", wantMethod)))
+		return
+	}
+	switch action {
+	case "":
+		wconf, err := loadWorldConfig(worldName, config)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, WorldDetail{
+			Name:     worldName,
+			Status:   worldListing(config)[worldName],
+			Settings: wconf,
+		})
+	case "history":
+		history, err := readHistory(worldName, config)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, history)
+	case "checkout":
+		httpCheckOut(w, r, worldName, rlog, config)
+	case "checkin":
+		httpCheckIn(w, r, worldName, rlog, config)
+	case "release":
+		ev := newEvent(EVENT_RELEASE, worldName, httpParam(r, "overseer"), r.RemoteAddr)
+		defer logEvent(ev, config)
+		err := releaseWorld(worldName, ev.Overseer, httpParam(r, "runes"), config)
+		if err != nil {
+			ev.failed(err)
+			httpError(w, http.StatusConflict, err)
+			return
+		}
+		tok, _ := getStatus(worldName)
+		tok.MagicRunes = ""
+		writeJSON(w, tok)
+	default:
+		httpError(w, http.StatusNotFound, errors.New(fmt.Sprintf("Unknown action '%s'", action)))
+	}
+}
+
+// streams the world's zip file in the response body, with the check-out token and hash in the headers
+func httpCheckOut(w http.ResponseWriter, r *http.Request, worldName string, rlog Logger, config ServerConfig) {
+	overseer := httpParam(r, "overseer")
+	if !validateName(overseer) {
+		httpError(w, http.StatusBadRequest, errors.New("Missing or invalid overseer name"))
+		return
+	}
+	ev := newEvent(EVENT_CHECKOUT, worldName, overseer, r.RemoteAddr)
+	defer logEvent(ev, config)
+	saveFormat, _ := strconv.ParseUint(httpParam(r, "saveformat"), 10, 32)
+	rlog.Infof("Overseer %s from HTTP client %s requested to check-out world %s", overseer, r.RemoteAddr, worldName)
+	co, err := beginCheckOut(worldName, overseer, httpParam(r, "dfversion"), uint32(saveFormat), config)
+	if err != nil {
+		ev.failed(err)
+		httpError(w, http.StatusConflict, err)
+		rlog.Warn(err)
+		return
+	}
+	ev.Revision = co.Hash
+	zipFileSrc, err := os.Open(co.ZipPath)
+	if err != nil {
+		ev.failed(err)
+		abortCheckOut(co, config)
+		httpError(w, http.StatusInternalServerError, err)
+		rlog.Warn(err)
+		return
+	}
+	defer zipFileSrc.Close()
+	tjstr, _ := json.Marshal(co.clientToken())
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Length", strconv.FormatInt(co.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(co.ZipPath)}))
+	w.Header().Set("X-CloudFort-Token", string(tjstr))
+	w.Header().Set("X-CloudFort-Hash", co.Hash)
+	w.WriteHeader(http.StatusOK)
+	ev.Bytes, err = io.Copy(w, zipFileSrc)
+	if err != nil {
+		// too late to tell the client
+		ev.failed(err)
+		rlog.Warn(err)
+		abortCheckOut(co, config)
+		return
+	}
+	err = finishCheckOut(co, config)
+	ev.failed(err)
+	rlog.Warn(err)
+}
+
+// receives a world save either as the raw request body or as the "save" file of a multipart form
+func httpCheckIn(w http.ResponseWriter, r *http.Request, worldName string, rlog Logger, config ServerConfig) {
+	wconf, err := loadWorldConfig(worldName, config)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if limit := sizeLimitBytes(wconf.WorldSizeLimitMB); limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
+	}
+	// (for multipart forms, this reads the whole form)
+	overseer := httpParam(r, "overseer")
+	magicRunes := httpParam(r, "runes")
+	opID := httpParam(r, "op")
+	rlog.Infof("Overseer %s from HTTP client %s requested to check-in world %s", overseer, r.RemoteAddr, worldName)
+	if opIDRegex.MatchString(opID) && checkInDone(worldName, overseer, opID, config) {
+		rlog.Infof("Check-in %s of world %s was already completed", opID, worldName)
+		tok, _ := getStatus(worldName)
+		tok.MagicRunes = ""
+		writeJSON(w, tok)
+		return
+	}
+	ev := newEvent(EVENT_CHECKIN, worldName, overseer, r.RemoteAddr)
+	defer logEvent(ev, config)
+	err = authorizeCheckIn(worldName, overseer, magicRunes)
+	if err != nil {
+		ev.failed(err)
+		httpError(w, http.StatusConflict, err)
+		rlog.Warn(err)
+		return
+	}
+	var upload io.Reader = r.Body
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		file, _, err := r.FormFile("save")
+		if err != nil {
+			ev.failed(err)
+			httpError(w, http.StatusBadRequest, errors.Wrap(err, "Missing 'save' file"))
+			return
+		}
+		defer file.Close()
+		upload = file
+	}
+	tmpFile, err := os.CreateTemp(config.TempFolder, fmt.Sprintf("CloudFort-upload-%s.*.temp", worldName))
+	if err != nil {
+		ev.failed(err)
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	tmpFilePath := tmpFile.Name()
+	defer os.Remove(tmpFilePath)
+	ev.Bytes, err = io.Copy(tmpFile, upload)
+	tmpFile.Close()
+	if err != nil {
+		ev.failed(err)
+		httpError(w, http.StatusBadRequest, err)
+		rlog.Warn(err)
+		return
+	}
+	ev.Revision, _ = hashFile(tmpFilePath)
+	if !opIDRegex.MatchString(opID) {
+		opID = ""
+	}
+	err = acceptCheckIn(worldName, overseer, magicRunes, tmpFilePath, httpParam(r, "hash"), opID, config)
+	if err != nil {
+		ev.failed(err)
+		httpError(w, http.StatusConflict, err)
+		rlog.Warn(err)
+		return
+	}
+	rlog.Infof("Check-in sucessful!")
+	tok, _ := getStatus(worldName)
+	tok.MagicRunes = ""
+	writeJSON(w, tok)
+}
+
+// reads a request parameter from the query string or form, or else from an X-CloudFort-<Name> header
+func httpParam(r *http.Request, name string) string {
+	v := r.FormValue(name)
+	if v == "" {
+		v = r.Header.Get("X-CloudFort-" + name)
+	}
+	return strings.TrimSpace(v)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	jstr, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jstr)
+}
+
+func httpError(w http.ResponseWriter, code int, e error) {
+	jstr, _ := json.Marshal(httpErrorResponse{Error: e.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(jstr)
+}
+
+// reads the history.csv entries for a world (or for all worlds if worldName is "")
+func readHistory(worldName string, config ServerConfig) ([]HistoryEntry, error) {
+	histFile := filepath.Join(config.WorldSaveFolder, "history.csv")
+	file, err := os.Open(histFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	history := make([]HistoryEntry, 0, len(records))
+	for i, rec := range records {
+		if i == 0 || len(rec) < 4 {
+			// header
+			continue
+		}
+		if worldName != "" && rec[1] != worldName {
+			continue
+		}
+		history = append(history, HistoryEntry{Time: rec[0], World: rec[1], Overseer: rec[2], Event: rec[3]})
+	}
+	return history, nil
+}
+
+const openAPIDescription = `{
+	"openapi": "3.0.3",
+	"info": {
+		"title": "CloudFort Server API",
+		"description": "Share Dwarf Fortress world saves between many players. Check-outs and check-ins through this API are equivalent to those made with the CloudFort client.",
+		"version": "` + CloudFortVersion + `"
+	},
+	"security": [{}, {"password": []}],
+	"paths": {
+		"/api/worlds": {
+			"get": {
+				"summary": "List all worlds and their status",
+				"responses": {
+					"200": {"description": "Map of world name to status", "content": {"application/json": {"schema": {"type": "object", "additionalProperties": {"$ref": "#/components/schemas/WorldStatus"}}}}}
+				}
+			}
+		},
+		"/api/worlds/{world}": {
+			"parameters": [{"$ref": "#/components/parameters/world"}],
+			"get": {
+				"summary": "Status and settings of one world",
+				"responses": {
+					"200": {"description": "World detail", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/WorldDetail"}}}},
+					"404": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/api/worlds/{world}/history": {
+			"parameters": [{"$ref": "#/components/parameters/world"}],
+			"get": {
+				"summary": "Event history of one world",
+				"responses": {
+					"200": {"description": "History entries, oldest first", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/HistoryEntry"}}}}},
+					"404": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/api/worlds/{world}/checkout": {
+			"parameters": [{"$ref": "#/components/parameters/world"}],
+			"post": {
+				"summary": "Check-out a world and download its save",
+				"parameters": [
+					{"name": "overseer", "in": "query", "required": true, "schema": {"type": "string"}},
+					{"name": "dfversion", "in": "query", "schema": {"type": "string"}, "description": "DF version of the player, eg 0.47.05"},
+					{"name": "saveformat", "in": "query", "schema": {"type": "integer"}, "description": "Save format number of the player's DF"}
+				],
+				"responses": {
+					"200": {
+						"description": "The zipped save. Keep the magic runes from the token, they are needed to check-in the world.",
+						"headers": {
+							"X-CloudFort-Token": {"description": "Check-out token (JSON)", "schema": {"type": "string"}},
+							"X-CloudFort-Hash": {"description": "MD5 hash of the zip file", "schema": {"type": "string"}}
+						},
+						"content": {"application/zip": {"schema": {"type": "string", "format": "binary"}}}
+					},
+					"409": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/api/worlds/{world}/checkin": {
+			"parameters": [{"$ref": "#/components/parameters/world"}],
+			"post": {
+				"summary": "Upload a zipped save and check-in a world",
+				"parameters": [
+					{"name": "overseer", "in": "query", "required": true, "schema": {"type": "string"}},
+					{"name": "runes", "in": "query", "schema": {"type": "string"}, "description": "Magic runes from the check-out token (can also be sent as the X-CloudFort-Runes header)"},
+					{"name": "hash", "in": "query", "schema": {"type": "string"}, "description": "Optional MD5 hash of the zip file"},
+					{"name": "op", "in": "query", "schema": {"type": "string"}, "description": "Optional operation ID (8 to 64 letters, digits or dashes) chosen by the client, so that retrying a check-in that already went through succeeds without uploading again"}
+				],
+				"requestBody": {
+					"required": true,
+					"content": {
+						"application/zip": {"schema": {"type": "string", "format": "binary"}},
+						"multipart/form-data": {"schema": {"type": "object", "properties": {
+							"save": {"type": "string", "format": "binary"},
+							"overseer": {"type": "string"},
+							"runes": {"type": "string"},
+							"hash": {"type": "string"},
+							"op": {"type": "string"}
+						}}}
+					}
+				},
+				"responses": {
+					"200": {"description": "New status of the world", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/LockToken"}}}},
+					"409": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/api/worlds/{world}/release": {
+			"parameters": [{"$ref": "#/components/parameters/world"}],
+			"post": {
+				"summary": "Give up a check-out without uploading, reverting the world to its last check-in",
+				"parameters": [
+					{"name": "overseer", "in": "query", "required": true, "schema": {"type": "string"}},
+					{"name": "runes", "in": "query", "schema": {"type": "string"}}
+				],
+				"responses": {
+					"200": {"description": "New status of the world", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/LockToken"}}}},
+					"409": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		}
+	},
+	"components": {
+		"securitySchemes": {
+			"password": {"type": "apiKey", "in": "header", "name": "X-CloudFort-Password", "description": "The server password, only needed if the server has one (can also be sent as the password parameter)"}
+		},
+		"parameters": {
+			"world": {"name": "world", "in": "path", "required": true, "schema": {"type": "string"}}
+		},
+		"responses": {
+			"Error": {"description": "The request failed", "content": {"application/json": {"schema": {"type": "object", "properties": {"Error": {"type": "string"}}}}}}
+		},
+		"schemas": {
+			"LockToken": {"type": "object", "properties": {
+				"Status": {"type": "string", "enum": ["available", "downloading", "checked-out", "invalid"]},
+				"Expires": {"type": "string", "format": "date-time"},
+				"CurrentOverseer": {"type": "string"},
+				"MagicRunes": {"type": "string"},
+				"CheckedOut": {"type": "string", "format": "date-time"}
+			}},
+			"WorldStatus": {"allOf": [{"$ref": "#/components/schemas/LockToken"}, {"type": "object", "properties": {
+				"Problem": {"type": "string"},
+				"Info": {"type": "object"},
+				"DFVersion": {"type": "string"},
+				"Description": {"type": "string"},
+				"Mods": {"type": "array", "items": {"type": "string"}},
+				"Queue": {"type": "array", "items": {"type": "string"}},
+				"ReservedFor": {"type": "string"},
+				"ReservedUntil": {"type": "string", "format": "date-time"}
+			}}]},
+			"WorldDetail": {"type": "object", "properties": {
+				"Name": {"type": "string"},
+				"Status": {"$ref": "#/components/schemas/WorldStatus"},
+				"Settings": {"type": "object"}
+			}},
+			"HistoryEntry": {"type": "object", "properties": {
+				"Time": {"type": "string", "format": "date-time"},
+				"World": {"type": "string"},
+				"Overseer": {"type": "string"},
+				"Event": {"type": "string"}
+			}}
+		}
+	}
+}
+`
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// counters for the /metrics endpoint, in the Prometheus text format
+// (the per-world counters are updated from the event log, see logEvent)
+type serverMetrics struct {
+	activeConnections int64 // (atomic, so it comes first to be 64-bit aligned)
+	lock              sync.Mutex
+	events            map[string]map[string]uint64 // event type -> world -> count of successful events
+	failures          map[string]uint64            // event type -> count of failed events
+	transferBytes     map[string]uint64            // "download" or "upload" -> bytes
+	transferSeconds   map[string]float64
+	transferCount     map[string]uint64
+	statusChanges     map[string]uint64 // new status -> count
+	hashMismatches    uint64
+}
+
+var metrics = serverMetrics{
+	events:          make(map[string]map[string]uint64),
+	failures:        make(map[string]uint64),
+	transferBytes:   make(map[string]uint64),
+	transferSeconds: make(map[string]float64),
+	transferCount:   make(map[string]uint64),
+	statusChanges:   make(map[string]uint64),
+}
+
+// events that move a world's save, and which direction it goes
+var transferDirections = map[string]string{
+	EVENT_CHECKOUT:   "download",
+	EVENT_PEEK:       "download",
+	EVENT_CHECKIN:    "upload",
+	EVENT_CHECKPOINT: "upload",
+}
+
+func (m *serverMetrics) recordEvent(ev *Event) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if ev.Result != RESULT_OK {
+		m.failures[ev.Type]++
+		return
+	}
+	if m.events[ev.Type] == nil {
+		m.events[ev.Type] = make(map[string]uint64)
+	}
+	m.events[ev.Type][ev.World]++
+	if direction, ok := transferDirections[ev.Type]; ok {
+		m.transferBytes[direction] += uint64(ev.Bytes)
+		m.transferSeconds[direction] += ev.Duration
+		m.transferCount[direction]++
+	}
+}
+
+func (m *serverMetrics) recordStatusChange(status string) {
+	m.lock.Lock()
+	m.statusChanges[status]++
+	m.lock.Unlock()
+}
+
+func (m *serverMetrics) recordHashMismatch() {
+	m.lock.Lock()
+	m.hashMismatches++
+	m.lock.Unlock()
+}
+
+func (m *serverMetrics) connectionOpened() {
+	atomic.AddInt64(&m.activeConnections, 1)
+}
+
+func (m *serverMetrics) connectionClosed() {
+	atomic.AddInt64(&m.activeConnections, -1)
+}
+
+func addMetricsHandler(mux *http.ServeMux, config ServerConfig) {
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if !httpAuthorized(w, r, config) {
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(metrics.export(config)))
+	})
+}
+
+// writes all metrics in the Prometheus text exposition format
+func (m *serverMetrics) export(config ServerConfig) string {
+	var sb strings.Builder
+	// gauges that are read when scraped
+	worldCounts := map[string]int{
+		STATUS_AVAILABLE:   0,
+		STATUS_DOWNLOADING: 0,
+		STATUS_CHECKOUT:    0,
+		STATUS_INVALID:     0,
+	}
+	for _, tok := range statusSnapshot(false) {
+		worldCounts[tok.Status]++
+	}
+	writeMetricHeader(&sb, "cloudfort_worlds", "gauge", "Number of worlds by status.")
+	for _, status := range sortedKeys(worldCounts) {
+		fmt.Fprintf(&sb, "cloudfort_worlds{status=%q} %d\n", status, worldCounts[status])
+	}
+	writeMetricHeader(&sb, "cloudfort_save_folder_bytes", "gauge", "Disk space used by the save folder (including revisions).")
+	fmt.Fprintf(&sb, "cloudfort_save_folder_bytes %d\n", folderSize(config.WorldSaveFolder))
+	writeMetricHeader(&sb, "cloudfort_active_connections", "gauge", "Number of open TCP connections from clients.")
+	fmt.Fprintf(&sb, "cloudfort_active_connections %d\n", atomic.LoadInt64(&m.activeConnections))
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	eventMetrics := []struct{ eventType, name, help string }{
+		{EVENT_CHECKOUT, "cloudfort_checkouts_total", "Successful check-outs."},
+		{EVENT_CHECKIN, "cloudfort_checkins_total", "Successful check-ins."},
+		{EVENT_RELEASE, "cloudfort_releases_total", "Check-outs given up without a check-in."},
+		{EVENT_EXPIRE, "cloudfort_expirations_total", "Check-outs that expired."},
+		{EVENT_ABORT, "cloudfort_aborted_downloads_total", "Check-outs whose download timed out."},
+		{EVENT_EXTEND, "cloudfort_extensions_total", "Check-out extensions."},
+		{EVENT_PEEK, "cloudfort_peeks_total", "Read-only copies downloaded by spectators."},
+		{EVENT_CHECKPOINT, "cloudfort_checkpoints_total", "Checkpoints uploaded during check-outs."},
+	}
+	for _, em := range eventMetrics {
+		writeMetricHeader(&sb, em.name, "counter", em.help)
+		counts := m.events[em.eventType]
+		worlds := make([]string, 0, len(counts))
+		for world := range counts {
+			worlds = append(worlds, world)
+		}
+		sort.Strings(worlds)
+		for _, world := range worlds {
+			fmt.Fprintf(&sb, "%s{world=%q} %d\n", em.name, world, counts[world])
+		}
+	}
+	writeMetricHeader(&sb, "cloudfort_failed_requests_total", "counter", "Requests that ended with an error, by event type.")
+	for _, t := range sortedKeys(m.failures) {
+		fmt.Fprintf(&sb, "cloudfort_failed_requests_total{type=%q} %d\n", t, m.failures[t])
+	}
+	directions := []string{"download", "upload"}
+	writeMetricHeader(&sb, "cloudfort_transfer_bytes_total", "counter", "Bytes of world saves transferred.")
+	for _, direction := range directions {
+		fmt.Fprintf(&sb, "cloudfort_transfer_bytes_total{direction=%q} %d\n", direction, m.transferBytes[direction])
+	}
+	writeMetricHeader(&sb, "cloudfort_transfer_duration_seconds", "summary", "Time taken by world save transfers.")
+	for _, direction := range directions {
+		fmt.Fprintf(&sb, "cloudfort_transfer_duration_seconds_sum{direction=%q} %g\n", direction, m.transferSeconds[direction])
+		fmt.Fprintf(&sb, "cloudfort_transfer_duration_seconds_count{direction=%q} %d\n", direction, m.transferCount[direction])
+	}
+	writeMetricHeader(&sb, "cloudfort_hash_mismatches_total", "counter", "Uploads rejected because the file hash did not match.")
+	fmt.Fprintf(&sb, "cloudfort_hash_mismatches_total %d\n", m.hashMismatches)
+	writeMetricHeader(&sb, "cloudfort_status_changes_total", "counter", "Changes of world status, by new status.")
+	for _, status := range sortedKeys(m.statusChanges) {
+		fmt.Fprintf(&sb, "cloudfort_status_changes_total{status=%q} %d\n", status, m.statusChanges[status])
+	}
+	return sb.String()
+}
+
+func writeMetricHeader(sb *strings.Builder, name string, metricType string, help string) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// returns the keys of a map[string]int or map[string]uint64 in order
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch mm := m.(type) {
+	case map[string]int:
+		for k := range mm {
+			keys = append(keys, k)
+		}
+	case map[string]uint64:
+		for k := range mm {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// total size of all files in a folder and its sub-folders
+func folderSize(dirPath string) int64 {
+	var size int64
+	filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// a request line from a client, split into its fields and checked by parseRequest
+// (the fields that a command does not use are left empty)
+type Request struct {
+	Command    string
+	Overseer   string
+	World      string
+	MagicRunes string // for checkin, release, extend and checkpoint
+	Revision   string // for peek, empty for the latest check-in
+	DFVersion  string // for checkout, empty if the client does not know its DF version
+	SaveFormat uint32 // for checkout, 0 if unknown
+	OpID       string // for checkin, chosen by the client so that it can safely retry, empty if not given
+}
+
+const (
+	MAX_REQUEST_LENGTH = 1024
+	MAX_NAME_LENGTH    = 128 // for overseer and world names
+)
+
+// the fields that follow the command name in each kind of request (fields in [] are optional)
+var requestFormats = map[string]string{
+	COM_CONCHECK:   "",
+	COM_STATUS:     "",
+	COM_CHECKOUT:   "overseer:world[:dfversion[:saveformat]]",
+	COM_CHECKIN:    "overseer:world:runes[:opid]",
+	COM_RELEASE:    "overseer:world:runes",
+	COM_EXTEND:     "overseer:world:runes",
+	COM_RESERVE:    "overseer:world",
+	COM_UNRESERVE:  "overseer:world",
+	COM_PEEK:       "overseer:world[:revision]",
+	COM_CHECKPOINT: "overseer:world:runes",
+}
+
+var magicRunesRegex = regexp.MustCompile(`^[A-Za-z0-9+/=]{1,64}$`)
+var dfVersionRegex = regexp.MustCompile(`^[A-Za-z0-9._ -]{0,32}$`)
+var opIDRegex = regexp.MustCompile(`^[A-Za-z0-9-]{8,64}$`)
+
+// splits a request line from a client and checks every field, so that the request handlers can trust them
+// worldExists is asked whether the named world is on this server
+func parseRequest(line string, worldExists func(string) bool) (Request, error) {
+	var req Request
+	if len(line) > MAX_REQUEST_LENGTH {
+		return req, errors.New(fmt.Sprintf("Request too long (%d bytes)", len(line)))
+	}
+	sp := strings.Split(line, ":")
+	req.Command = sp[0]
+	format, known := requestFormats[req.Command]
+	if !known {
+		return req, errors.New(fmt.Sprintf("Unknown request '%s'", truncateString(req.Command, 32)))
+	}
+	args := sp[1:]
+	minArgs, maxArgs := 0, 0
+	if format != "" {
+		maxArgs = len(strings.Split(format, ":"))
+		minArgs = len(strings.Split(format[:strings.IndexAny(format+"[", "[")], ":"))
+	}
+	if len(args) < minArgs || len(args) > maxArgs {
+		if format == "" {
+			return req, errors.New(fmt.Sprintf("Invalid %s request: expected just %s", req.Command, req.Command))
+		}
+		return req, errors.New(fmt.Sprintf("Invalid %s request: expected %s:%s", req.Command, req.Command, format))
+	}
+	if maxArgs == 0 {
+		return req, nil
+	}
+	req.Overseer = args[0]
+	if len(req.Overseer) > MAX_NAME_LENGTH || !validateName(req.Overseer) {
+		return req, errors.New(fmt.Sprintf("Invalid overseer name '%s'", truncateString(req.Overseer, 32)))
+	}
+	req.World = args[1]
+	if !validWorldName(req.World) {
+		return req, errors.New(fmt.Sprintf("Invalid world name '%s'", truncateString(req.World, 32)))
+	}
+	if !worldExists(req.World) {
+		return req, errors.New(fmt.Sprintf("No world named '%s'", req.World))
+	}
+	switch req.Command {
+	case COM_CHECKIN, COM_RELEASE, COM_EXTEND, COM_CHECKPOINT:
+		req.MagicRunes = args[2]
+		if !magicRunesRegex.MatchString(req.MagicRunes) {
+			return req, errors.New("Invalid magic runes")
+		}
+		if len(args) > 3 {
+			req.OpID = args[3]
+			if !opIDRegex.MatchString(req.OpID) {
+				return req, errors.New(fmt.Sprintf("Invalid operation ID '%s'", truncateString(req.OpID, 32)))
+			}
+		}
+	case COM_PEEK:
+		if len(args) > 2 {
+			req.Revision = args[2]
+			if _, err := time.Parse(REVISION_TIME_FORMAT, req.Revision); err != nil {
+				return req, errors.New(fmt.Sprintf("Invalid revision '%s'", truncateString(req.Revision, 32)))
+			}
+		}
+	case COM_CHECKOUT:
+		if len(args) > 2 {
+			req.DFVersion = args[2]
+			if !dfVersionRegex.MatchString(req.DFVersion) {
+				return req, errors.New(fmt.Sprintf("Invalid Dwarf Fortress version '%s'", truncateString(req.DFVersion, 32)))
+			}
+		}
+		if len(args) > 3 && args[3] != "" {
+			n, err := strconv.ParseUint(args[3], 10, 32)
+			if err != nil {
+				return req, errors.New(fmt.Sprintf("Invalid save format '%s'", truncateString(args[3], 32)))
+			}
+			req.SaveFormat = uint32(n)
+		}
+	}
+	return req, nil
+}
+
+// shortens a string from a client before it is put in an error message
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// whether a world can be named in requests (importWorld marks worlds with other names as invalid)
+func validWorldName(name string) bool {
+	return len(name) <= MAX_NAME_LENGTH && validateName(name) && name != "." && name != ".."
+}
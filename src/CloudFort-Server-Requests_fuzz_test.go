@@ -0,0 +1,35 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"testing"
+)
+
+// go test -fuzz FuzzParseRequest <server files> CloudFort-Server-Requests_test.go CloudFort-Server-Requests_fuzz_test.go
+func FuzzParseRequest(f *testing.F) {
+	for _, line := range loadRequestSeeds(f) {
+		f.Add(line)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		req, err := parseRequest(line, testWorldExists)
+		if err != nil {
+			return
+		}
+		if len(line) > MAX_REQUEST_LENGTH {
+			t.Errorf("accepted a request of %d bytes", len(line))
+		}
+		if _, known := requestFormats[req.Command]; !known {
+			t.Errorf("accepted unknown command %q", req.Command)
+		}
+		if req.World != "" && !testWorldExists(req.World) {
+			t.Errorf("accepted unknown world %q", req.World)
+		}
+		for _, name := range []string{req.Overseer, req.World} {
+			if req.World != "" && (len(name) > MAX_NAME_LENGTH || !validateName(name)) {
+				t.Errorf("accepted invalid name %q", name)
+			}
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the request lines in testdata/requests, one per file
+func loadRequestSeeds(t testing.TB) map[string]string {
+	files, err := filepath.Glob(filepath.Join("testdata", "requests", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeds := make(map[string]string)
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeds[strings.TrimSuffix(filepath.Base(f), ".txt")] = strings.TrimSuffix(string(data), "\n")
+	}
+	return seeds
+}
+
+func testWorldExists(world string) bool {
+	return world == "demo_region"
+}
+
+func TestParseRequest(t *testing.T) {
+	longName := strings.Repeat("U", MAX_NAME_LENGTH)
+	tests := []struct {
+		seed    string
+		want    Request
+		wantErr string // part of the error message, "" if the request is valid
+	}{
+		{seed: "status", want: Request{Command: COM_STATUS}},
+		{seed: "concheck", want: Request{Command: COM_CONCHECK}},
+		{seed: "status-extra-field", wantErr: "expected just status"},
+		{seed: "unknown-command", wantErr: "Unknown request 'launch'"},
+		{seed: "empty-line", wantErr: "Unknown request ''"},
+		{seed: "checkout", want: Request{Command: COM_CHECKOUT, Overseer: "Urist", World: "demo_region"}},
+		{seed: "checkout-version", want: Request{Command: COM_CHECKOUT, Overseer: "Urist", World: "demo_region", DFVersion: "0.47.05", SaveFormat: 1779}},
+		{seed: "checkout-empty-format", want: Request{Command: COM_CHECKOUT, Overseer: "Urist", World: "demo_region", DFVersion: "50.11"}},
+		{seed: "checkout-bad-format", wantErr: "Invalid save format 'x'"},
+		{seed: "checkout-bad-version", wantErr: "Invalid Dwarf Fortress version"},
+		{seed: "checkout-short", wantErr: "expected checkout:overseer:world[:dfversion[:saveformat]]"},
+		{seed: "checkout-extra-colons", wantErr: "Invalid checkout request"},
+		{seed: "checkout-empty-overseer", wantErr: "Invalid overseer name ''"},
+		{seed: "reserve-empty-world", wantErr: "Invalid world name ''"},
+		{seed: "reserve-no-such-world", wantErr: "No world named 'other_world'"},
+		{seed: "reserve-percent", wantErr: "Invalid overseer name"},
+		{seed: "peek-dotdot", wantErr: "Invalid world name '..'"},
+		{seed: "reserve-longest-name", want: Request{Command: COM_RESERVE, Overseer: longName, World: "demo_region"}},
+		{seed: "reserve-long-name", wantErr: "Invalid overseer name"},
+		{seed: "request-too-long", wantErr: "Request too long"},
+		{seed: "checkin", want: Request{Command: COM_CHECKIN, Overseer: "Urist", World: "demo_region", MagicRunes: "Ab0+/="}},
+		{seed: "checkin-opid", want: Request{Command: COM_CHECKIN, Overseer: "Urist", World: "demo_region", MagicRunes: "Ab0", OpID: "0123456789abcdef"}},
+		{seed: "checkin-bad-opid", wantErr: "Invalid operation ID 'short'"},
+		{seed: "checkin-bad-runes", wantErr: "Invalid magic runes"},
+		{seed: "checkin-empty-runes", wantErr: "Invalid magic runes"},
+		{seed: "release-opid", wantErr: "expected release:overseer:world:runes"},
+		{seed: "peek-revision", want: Request{Command: COM_PEEK, Overseer: "Urist", World: "demo_region", Revision: "20240101-120000"}},
+		{seed: "peek-bad-revision", wantErr: "Invalid revision 'yesterday'"},
+		{seed: "checkpoint", want: Request{Command: COM_CHECKPOINT, Overseer: "Urist", World: "demo_region", MagicRunes: "Ab0"}},
+	}
+	seeds := loadRequestSeeds(t)
+	tested := make(map[string]bool)
+	for _, tt := range tests {
+		tested[tt.seed] = true
+		line, ok := seeds[tt.seed]
+		if !ok {
+			t.Errorf("no seed file testdata/requests/%s.txt", tt.seed)
+			continue
+		}
+		req, err := parseRequest(line, testWorldExists)
+		if tt.wantErr != "" {
+			if err == nil {
+				t.Errorf("%s: parsed %q as %+v, want an error containing %q", tt.seed, line, req, tt.wantErr)
+			} else if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error %q, want one containing %q", tt.seed, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.seed, err)
+		} else if req != tt.want {
+			t.Errorf("%s: parsed as %+v, want %+v", tt.seed, req, tt.want)
+		}
+	}
+	// (so that a new seed can't be left out of the table)
+	for seed := range seeds {
+		if !tested[seed] {
+			t.Errorf("seed %s has no test case", seed)
+		}
+	}
+}
+
+// a world whose name can't be sent in requests is not made available
+func TestImportWorldChecksName(t *testing.T) {
+	config := ServerConfig{WorldSaveFolder: t.TempDir(), ServerOverseerName: "Armok"}
+	statusLock.Lock()
+	statusMap = make(map[string]LockToken)
+	problemMap = make(map[string]string)
+	infoMap = make(map[string]SaveInfo)
+	queueMap = make(map[string]TurnQueue)
+	statusLock.Unlock()
+	err := os.MkdirAll(stateDir(config), 0775)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(config.WorldSaveFolder, "history.csv"), []byte("Time,World,Overseer,Event\n"), 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := getDemoWorld()
+	for _, name := range []string{"demo_region", "100%_dwarf", "a;b"} {
+		err = ioutil.WriteFile(filepath.Join(config.WorldSaveFolder, name+".zip"), data, 0664)
+		if err != nil {
+			t.Fatal(err)
+		}
+		importWorld(filepath.Join(config.WorldSaveFolder, name+".zip"), config)
+	}
+	if tok, _ := getStatus("demo_region"); tok.Status != STATUS_AVAILABLE {
+		t.Errorf("demo_region is %s, want %s", tok.Status, STATUS_AVAILABLE)
+	}
+	for _, name := range []string{"100%_dwarf", "a;b"} {
+		if tok, _ := getStatus(name); tok.Status != STATUS_INVALID {
+			t.Errorf("%s is %s, want %s", name, tok.Status, STATUS_INVALID)
+		}
+		if problem := problemMap[name]; !strings.Contains(problem, "rename the zip file") {
+			t.Errorf("%s has the problem %q, want one about its name", name, problem)
+		}
+	}
+}
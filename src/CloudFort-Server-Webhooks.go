@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// an outgoing webhook, announcing world events in a chat server (or anything else that accepts HTTP requests)
+type WebhookConfig struct {
+	URL       string
+	Format    string            // "json" (the default), "discord" or "matrix"
+	Events    []string          // event types to announce, empty for check-outs, check-ins, releases, expirations and turns
+	Worlds    []string          // worlds to announce, empty for all
+	Headers   map[string]string // extra HTTP headers, eg "Authorization": "Bearer <access token>" for Matrix
+	Templates map[string]string // message text for each event type, as a Go template using the Event fields
+}
+
+const (
+	WEBHOOK_JSON    = "json"
+	WEBHOOK_DISCORD = "discord"
+	WEBHOOK_MATRIX  = "matrix"
+)
+
+var defaultWebhookEvents = []string{EVENT_CHECKOUT, EVENT_CHECKIN, EVENT_RELEASE, EVENT_EXPIRE, EVENT_TURN}
+
+var defaultWebhookTemplates = map[string]string{
+	EVENT_CHECKOUT:   "{{.Overseer}} checked-out {{.World}}",
+	EVENT_CHECKIN:    "{{.Overseer}} checked-in {{.World}}",
+	EVENT_RELEASE:    "{{.Overseer}} gave up {{.World}} without checking it in",
+	EVENT_EXPIRE:     "The check-out of {{.World}} by {{.Overseer}} expired, so the world was {{if .Revision}}set to their last checkpoint{{else}}reverted{{end}}",
+	EVENT_ABORT:      "{{.Overseer}} did not finish downloading {{.World}}, so it is available again",
+	EVENT_CHECKPOINT: "{{.Overseer}} saved a checkpoint of {{.World}}",
+	EVENT_TURN:       "It is now the turn of {{.Overseer}} to play {{.World}}",
+}
+
+// body of the generic JSON webhook
+type WebhookPayload struct {
+	Event   Event
+	Message string
+}
+
+// a webhook request waiting in the queue (saved to webhook-queue.json in the server's state folder, so that nothing is lost on a restart)
+// the hook's headers are looked up when it is sent, so that access tokens are not written to the queue file
+type webhookDelivery struct {
+	ID       string
+	Hook     string // URL of the hook in the config
+	URL      string
+	Method   string
+	Body     string
+	Attempts int
+	NextTry  string
+}
+
+var webhookQueue []webhookDelivery
+var webhookLock sync.Mutex
+var webhookCounter uint64
+var webhookWake = make(chan bool, 1)
+
+func webhookSanityCheck(c ServerConfig) error {
+	for i, hook := range c.Webhooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New(fmt.Sprintf("Webhook %d has an invalid URL '%s'", i+1, hook.URL))
+		}
+		if hook.Format != "" && hook.Format != WEBHOOK_JSON && hook.Format != WEBHOOK_DISCORD && hook.Format != WEBHOOK_MATRIX {
+			return errors.New(fmt.Sprintf("Webhook %d Format must be '%s', '%s' or '%s', not '%s'", i+1, WEBHOOK_JSON, WEBHOOK_DISCORD, WEBHOOK_MATRIX, hook.Format))
+		}
+		for eventType, text := range hook.Templates {
+			_, err := template.New(eventType).Parse(text)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid template for %s events in webhook %d", eventType, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// queues the webhook requests for an event
+func notifyWebhooks(ev *Event, config ServerConfig) {
+	if len(config.Webhooks) == 0 || ev.Result != RESULT_OK {
+		return
+	}
+	queued := false
+	for _, hook := range config.Webhooks {
+		if !hook.wants(ev) {
+			continue
+		}
+		delivery, err := hook.request(ev)
+		if err != nil {
+			warn(errors.Wrapf(err, "Failed to prepare webhook for %s", hook.URL))
+			continue
+		}
+		webhookLock.Lock()
+		webhookQueue = append(webhookQueue, delivery)
+		webhookLock.Unlock()
+		queued = true
+	}
+	if queued {
+		warn(saveWebhookQueue(config))
+		select {
+		case webhookWake <- true:
+		default:
+		}
+	}
+}
+
+func (hook WebhookConfig) wants(ev *Event) bool {
+	events := hook.Events
+	if len(events) == 0 {
+		events = defaultWebhookEvents
+	}
+	return containsString(events, ev.Type) && (len(hook.Worlds) == 0 || containsString(hook.Worlds, ev.World))
+}
+
+// builds the request for an event in the format of this webhook
+func (hook WebhookConfig) request(ev *Event) (webhookDelivery, error) {
+	text, ok := hook.Templates[ev.Type]
+	if !ok {
+		text, ok = defaultWebhookTemplates[ev.Type]
+	}
+	if !ok {
+		text = "{{.Type}}: {{.World}} ({{.Overseer}})"
+	}
+	tmpl, err := template.New(ev.Type).Parse(text)
+	if err != nil {
+		return webhookDelivery{}, err
+	}
+	var msg bytes.Buffer
+	err = tmpl.Execute(&msg, ev)
+	if err != nil {
+		return webhookDelivery{}, err
+	}
+	d := webhookDelivery{
+		ID:      fmt.Sprintf("cloudfort-%d-%d", time.Now().Unix(), atomic.AddUint64(&webhookCounter, 1)),
+		Hook:    hook.URL,
+		URL:     hook.URL,
+		Method:  http.MethodPost,
+		NextTry: time.Now().Format(time.RFC3339),
+	}
+	var payload interface{}
+	switch hook.Format {
+	case WEBHOOK_DISCORD:
+		payload = map[string]string{"username": "CloudFort", "content": msg.String()}
+	case WEBHOOK_MATRIX:
+		// the Matrix send API is a PUT with a transaction ID in the URL, eg
+		// https://matrix.example.org/_matrix/client/v3/rooms/<room>/send/m.room.message/{txnId}
+		payload = map[string]string{"msgtype": "m.text", "body": msg.String()}
+		if strings.Contains(hook.URL, "{txnId}") {
+			d.URL = strings.Replace(hook.URL, "{txnId}", d.ID, 1)
+			d.Method = http.MethodPut
+		}
+	default:
+		pub := *ev
+		// (the overseer's IP address is not for chat servers)
+		pub.Client = ""
+		payload = WebhookPayload{Event: pub, Message: msg.String()}
+	}
+	jstr, err := json.Marshal(payload)
+	if err != nil {
+		return d, err
+	}
+	d.Body = string(jstr)
+	return d, nil
+}
+
+// sends the queued webhook requests (and blocks forever)
+func webhookSender(config ServerConfig) {
+	warn(loadWebhookQueue(config))
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		sendDueWebhooks(config)
+		select {
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+	}
+}
+
+func sendDueWebhooks(config ServerConfig) {
+	tnow := time.Now()
+	webhookLock.Lock()
+	due := make([]webhookDelivery, 0, len(webhookQueue))
+	for _, d := range webhookQueue {
+		nextTry, err := time.Parse(time.RFC3339, d.NextTry)
+		if err != nil || !nextTry.After(tnow) {
+			due = append(due, d)
+		}
+	}
+	webhookLock.Unlock()
+	if len(due) == 0 {
+		return
+	}
+	for _, d := range due {
+		hook, configured := findWebhook(d.Hook, config)
+		err := errors.New("the webhook is no longer in server-config.json")
+		if configured {
+			err = sendWebhook(d, hook.Headers)
+		}
+		webhookLock.Lock()
+		for i := range webhookQueue {
+			if webhookQueue[i].ID != d.ID {
+				continue
+			}
+			if err == nil {
+				webhookQueue = append(webhookQueue[:i], webhookQueue[i+1:]...)
+				break
+			}
+			if !configured {
+				warn(errors.Wrapf(err, "Dropping webhook %s", d.URL))
+				webhookQueue = append(webhookQueue[:i], webhookQueue[i+1:]...)
+				break
+			}
+			webhookQueue[i].Attempts++
+			if webhookQueue[i].Attempts > config.WebhookRetries {
+				warn(errors.Wrapf(err, "Giving up on webhook %s after %d attempts", d.URL, webhookQueue[i].Attempts))
+				webhookQueue = append(webhookQueue[:i], webhookQueue[i+1:]...)
+			} else {
+				// wait longer after each failure: 30s, 1m, 2m, 4m... up to an hour
+				wait := 30 * time.Second << uint(webhookQueue[i].Attempts-1)
+				if wait > time.Hour || wait <= 0 {
+					wait = time.Hour
+				}
+				webhookQueue[i].NextTry = time.Now().Add(wait).Format(time.RFC3339)
+				warn(errors.Wrapf(err, "Webhook %s failed, trying again in %s", d.URL, wait))
+			}
+			break
+		}
+		webhookLock.Unlock()
+	}
+	warn(saveWebhookQueue(config))
+}
+
+// the configured webhook with this URL
+func findWebhook(hookURL string, config ServerConfig) (WebhookConfig, bool) {
+	for _, hook := range config.Webhooks {
+		if hook.URL == hookURL {
+			return hook, true
+		}
+	}
+	return WebhookConfig{}, false
+}
+
+func sendWebhook(d webhookDelivery, headers map[string]string) error {
+	req, err := http.NewRequest(d.Method, d.URL, strings.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", fmt.Sprintf("CloudFort/%s", CloudFortVersion))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(body))))
+	}
+	logger.Debugf("Webhook %s sent", d.URL)
+	return nil
+}
+
+func saveWebhookQueue(config ServerConfig) error {
+	webhookLock.Lock()
+	defer webhookLock.Unlock()
+	queueFile := stateFile("webhook-queue.json", config)
+	if len(webhookQueue) == 0 {
+		if fileExists(queueFile) {
+			return os.Remove(queueFile)
+		}
+		return nil
+	}
+	jstr, _ := json.MarshalIndent(webhookQueue, "", "\t")
+	_, err := ensureDir(stateDir(config))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(queueFile, jstr, 0664)
+}
+
+func loadWebhookQueue(config ServerConfig) error {
+	queueFile := stateFile("webhook-queue.json", config)
+	if !fileExists(queueFile) {
+		return nil
+	}
+	jstr, err := ioutil.ReadFile(queueFile)
+	if err != nil {
+		return err
+	}
+	webhookLock.Lock()
+	defer webhookLock.Unlock()
+	err = json.Unmarshal(jstr, &webhookQueue)
+	for i := range webhookQueue {
+		// (queued by an older version, which did not record the hook)
+		if webhookQueue[i].Hook == "" {
+			webhookQueue[i].Hook = webhookQueue[i].URL
+		}
+	}
+	return err
+}
+
+// the "webhook-test" subcommand: sends an example check-in event to every webhook right away
+func testWebhooks() error {
+	config := readConfig()
+	if len(config.Webhooks) == 0 {
+		return errors.New("There are no Webhooks in server-config.json")
+	}
+	ev := &Event{
+		Time:     time.Now().Format(time.RFC3339),
+		Type:     EVENT_CHECKIN,
+		World:    "test_world",
+		Overseer: "Urist",
+		Result:   RESULT_OK,
+	}
+	for _, hook := range config.Webhooks {
+		d, err := hook.request(ev)
+		if err == nil {
+			err = sendWebhook(d, hook.Headers)
+		}
+		if err != nil {
+			fmt.Printf("%s: FAILED: %v\n", hook.URL, err)
+		} else {
+			fmt.Printf("%s: OK\n", hook.URL)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a chat server that fails the first requests it gets, then records the bodies of the rest
+type fakeChatServer struct {
+	lock     sync.Mutex
+	failures int
+	requests int
+	bodies   []string
+	auth     []string // Authorization headers of the recorded bodies
+}
+
+func (f *fakeChatServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests++
+	if f.failures > 0 {
+		f.failures--
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+		return
+	}
+	f.bodies = append(f.bodies, string(body))
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+}
+
+func webhookTestConfig(t *testing.T, url string, retries int) ServerConfig {
+	webhookLock.Lock()
+	webhookQueue = nil
+	webhookLock.Unlock()
+	return ServerConfig{
+		WorldSaveFolder: t.TempDir(),
+		WebhookRetries:  retries,
+		Webhooks:        []WebhookConfig{{URL: url}},
+	}
+}
+
+func testCheckInEvent() *Event {
+	return &Event{
+		Time:     time.Now().Format(time.RFC3339),
+		Type:     EVENT_CHECKIN,
+		World:    "test_world",
+		Overseer: "Urist",
+		Client:   "192.0.2.7:51234",
+		Result:   RESULT_OK,
+	}
+}
+
+// makes every queued webhook due right away instead of after its back-off
+func makeWebhooksDue() {
+	webhookLock.Lock()
+	defer webhookLock.Unlock()
+	for i := range webhookQueue {
+		webhookQueue[i].NextTry = time.Now().Add(-time.Second).Format(time.RFC3339)
+	}
+}
+
+func queuedWebhooks() []webhookDelivery {
+	webhookLock.Lock()
+	defer webhookLock.Unlock()
+	return append([]webhookDelivery{}, webhookQueue...)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	chat := &fakeChatServer{}
+	srv := httptest.NewServer(chat)
+	defer srv.Close()
+	config := webhookTestConfig(t, srv.URL, 5)
+
+	notifyWebhooks(testCheckInEvent(), config)
+	if n := len(queuedWebhooks()); n != 1 {
+		t.Fatalf("%d webhooks queued, want 1", n)
+	}
+	sendDueWebhooks(config)
+	if n := len(queuedWebhooks()); n != 0 {
+		t.Fatalf("%d webhooks still queued after sending, want 0", n)
+	}
+	if len(chat.bodies) != 1 {
+		t.Fatalf("chat server got %d messages, want 1", len(chat.bodies))
+	}
+	var payload WebhookPayload
+	err := json.Unmarshal([]byte(chat.bodies[0]), &payload)
+	if err != nil {
+		t.Fatalf("invalid payload %s: %v", chat.bodies[0], err)
+	}
+	if payload.Message != "Urist checked-in test_world" {
+		t.Errorf("message is %q", payload.Message)
+	}
+	if payload.Event.World != "test_world" || payload.Event.Type != EVENT_CHECKIN {
+		t.Errorf("wrong event in payload: %+v", payload.Event)
+	}
+	if strings.Contains(chat.bodies[0], "192.0.2.7") {
+		t.Errorf("payload contains the client address: %s", chat.bodies[0])
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	chat := &fakeChatServer{failures: 2}
+	srv := httptest.NewServer(chat)
+	defer srv.Close()
+	config := webhookTestConfig(t, srv.URL, 5)
+	queueFile := stateFile("webhook-queue.json", config)
+
+	notifyWebhooks(testCheckInEvent(), config)
+	sendDueWebhooks(config)
+	queue := queuedWebhooks()
+	if len(queue) != 1 || queue[0].Attempts != 1 {
+		t.Fatalf("after one failure the queue is %+v, want one delivery with 1 attempt", queue)
+	}
+	nextTry, _ := time.Parse(time.RFC3339, queue[0].NextTry)
+	if !nextTry.After(time.Now()) {
+		t.Errorf("failed webhook is tried again at %s, want a later time", queue[0].NextTry)
+	}
+	// not due yet, so nothing is sent
+	sendDueWebhooks(config)
+	if chat.requests != 1 {
+		t.Errorf("chat server got %d requests before the webhook was due, want 1", chat.requests)
+	}
+	if !fileExists(queueFile) {
+		t.Errorf("the failed webhook was not saved to %s", queueFile)
+	}
+
+	makeWebhooksDue()
+	sendDueWebhooks(config)
+	if queue := queuedWebhooks(); len(queue) != 1 || queue[0].Attempts != 2 {
+		t.Fatalf("after two failures the queue is %+v, want one delivery with 2 attempts", queue)
+	}
+	makeWebhooksDue()
+	sendDueWebhooks(config)
+	if n := len(queuedWebhooks()); n != 0 {
+		t.Fatalf("%d webhooks still queued after the chat server came back, want 0", n)
+	}
+	if chat.requests != 3 || len(chat.bodies) != 1 {
+		t.Errorf("chat server got %d requests and %d messages, want 3 and 1", chat.requests, len(chat.bodies))
+	}
+	if fileExists(queueFile) {
+		t.Errorf("%s was not removed when the queue was empty", queueFile)
+	}
+}
+
+func TestWebhookGiveUp(t *testing.T) {
+	chat := &fakeChatServer{failures: 10}
+	srv := httptest.NewServer(chat)
+	defer srv.Close()
+	config := webhookTestConfig(t, srv.URL, 1)
+
+	notifyWebhooks(testCheckInEvent(), config)
+	sendDueWebhooks(config)
+	makeWebhooksDue()
+	sendDueWebhooks(config)
+	if n := len(queuedWebhooks()); n != 0 {
+		t.Fatalf("%d webhooks still queued after the retries ran out, want 0", n)
+	}
+	if chat.requests != 2 {
+		t.Errorf("chat server got %d requests, want 2 (one try and one retry)", chat.requests)
+	}
+}
+
+func TestWebhookHeadersNotSaved(t *testing.T) {
+	chat := &fakeChatServer{failures: 1}
+	srv := httptest.NewServer(chat)
+	defer srv.Close()
+	config := webhookTestConfig(t, srv.URL, 5)
+	config.Webhooks[0].Headers = map[string]string{"Authorization": "Bearer s3cret"}
+
+	notifyWebhooks(testCheckInEvent(), config)
+	sendDueWebhooks(config)
+	queued, err := ioutil.ReadFile(stateFile("webhook-queue.json", config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(queued), "s3cret") {
+		t.Errorf("the webhook queue file contains the access token: %s", queued)
+	}
+	makeWebhooksDue()
+	sendDueWebhooks(config)
+	if len(chat.auth) != 1 || chat.auth[0] != "Bearer s3cret" {
+		t.Errorf("chat server got the Authorization headers %q, want the configured one", chat.auth)
+	}
+}
+
+func TestWebhookRemovedFromConfig(t *testing.T) {
+	chat := &fakeChatServer{failures: 1}
+	srv := httptest.NewServer(chat)
+	defer srv.Close()
+	config := webhookTestConfig(t, srv.URL, 5)
+
+	notifyWebhooks(testCheckInEvent(), config)
+	sendDueWebhooks(config)
+	// the server is restarted without the webhook
+	config.Webhooks = nil
+	makeWebhooksDue()
+	sendDueWebhooks(config)
+	if n := len(queuedWebhooks()); n != 0 {
+		t.Errorf("%d webhooks still queued after the hook was removed, want 0", n)
+	}
+	if chat.requests != 1 {
+		t.Errorf("chat server got %d requests, want 1", chat.requests)
+	}
+}
+
+func TestWebhookQueueSurvivesRestart(t *testing.T) {
+	config := webhookTestConfig(t, "http://127.0.0.1:1/unreachable", 5)
+	notifyWebhooks(testCheckInEvent(), config)
+	saved := queuedWebhooks()
+
+	// a restarted server loads the queue from its state folder
+	webhookLock.Lock()
+	webhookQueue = nil
+	webhookLock.Unlock()
+	err := loadWebhookQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := queuedWebhooks()
+	if len(loaded) != 1 || loaded[0].ID != saved[0].ID || loaded[0].Body != saved[0].Body {
+		t.Errorf("loaded queue %+v, want %+v", loaded, saved)
+	}
+}
@@ -3,17 +3,21 @@ package main
 import (
 	"bufio"
 	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -30,12 +34,91 @@ type ServerConfig struct {
 	PortNumber         int64
 	HostBindAddress    string // "0.0.0.0" for ipv4, "::" for ipv6
 	ServerOverseerName string
+	InvalidWorldAction string // what to do with zips that are not valid saves: "mark" or "quarantine"
+	DFVersionPolicy    string // what to do when a client has the wrong DF version: "refuse", "warn" or "ignore"
+	MaxCheckOutTime    string // limit for check-out time including extensions
+	ExtensionTime      string // how much time each extension request adds
+	CheckInGracePeriod string // how long after expiration a late check-in is still accepted
+	ReservationTime    string // how long the next overseer in the queue has to check-out a world before losing their turn
+	HTTPPortNumber     int64  // port for the HTTP API and web dashboard, 0 to disable them
+	RevisionsKept      int    // number of past check-ins of each world to keep in the revisions folder
+	SpectatorDownloads bool   // whether anyone can download read-only copies of worlds (with the peek command or from the web dashboard)
+	Logging            LogConfig
+	Webhooks           []WebhookConfig // notifications of world events sent to chat servers or other web services
+	WebhookRetries     int             // how many times to retry a webhook request that failed
+	Email              EmailConfig     // email reminders for overseers
+	TLSCertFile        string          // certificate and key files to serve with TLS, empty for plain TCP (and HTTP)
+	TLSKeyFile         string
+	Password           string // if set, clients must give this password with each request
+	ExpirationAction   string // what happens to the world when a check-out expires: "revert" to the last check-in, or "checkpoint" to keep the latest checkpoint (if there is one)
 }
 
+// the queue of overseers waiting to check-out a world, saved to <world>.dfq in the save folder
+type TurnQueue struct {
+	Overseers     []string
+	ReservedUntil string // while the world is available, only the first overseer in the queue can check it out until this time
+}
+
+// optional per-world settings, read from <world>.json in the save folder
+// settings that are left empty fall back to the ServerConfig
+type WorldConfig struct {
+	Description        string
+	DFVersion          string
+	DFVersionPolicy    string
+	Mods               []string
+	CheckOutTimeLimit  string
+	DownloadTimeLimit  string
+	MaxCheckOutTime    string
+	ExtensionTime      string
+	CheckInGracePeriod string
+	ReservationTime    string
+	WorldSizeLimitMB   float64
+	AllowedOverseers   []string // if empty, anyone can check-out this world
+	SpectatorDownloads *bool
+	ExpirationAction   string
+	SaveFiles          []string // patterns of files to add to or leave out of the world's saves (see saveFileMatcher)
+}
+
+const (
+	INVALID_MARK       = "mark"
+	INVALID_QUARANTINE = "quarantine"
+)
+
+const REVISION_TIME_FORMAT = "20060102-150405"
+
+// the server's own files (checkins.json, overseers.json and webhook-queue.json) are kept in this sub-folder of the save
+// folder, so that they can't be mistaken for the <world>.json settings of a world
+const STATE_FOLDER = "cloudfort"
+
+const (
+	DFVERSION_REFUSE = "refuse"
+	DFVERSION_WARN   = "warn"
+	DFVERSION_IGNORE = "ignore"
+)
+
 var statusMap map[string]LockToken
+var problemMap map[string]string // reasons why invalid worlds are invalid
+var infoMap map[string]SaveInfo
+var queueMap map[string]TurnQueue
 var statusLock sync.Mutex
 
 func main() {
+	// "query" searches the event log instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		fail(queryEvents(os.Args[2:]))
+		return
+	}
+	// "webhook-test" sends an example notification to each webhook
+	if len(os.Args) > 1 && os.Args[1] == "webhook-test" {
+		fail(testWebhooks())
+		return
+	}
+	// "email-test <address>" sends an example reminder email
+	if len(os.Args) > 1 && os.Args[1] == "email-test" {
+		fail(testEmail(os.Args[2:]))
+		return
+	}
+
 	// first, initialize
 	//thisFile, err := os.Executable()
 	//fail(err)
@@ -51,319 +134,761 @@ func main() {
 	}()
 	go expirationChecker(expTicker, done, config)
 
+	// optionally, start sending notifications
+	if len(config.Webhooks) > 0 {
+		go webhookSender(config)
+	}
+
+	// optionally, start the HTTP API
+	if config.HTTPPortNumber > 0 {
+		go serveHTTP(config)
+	}
+
 	// finally, start network service
 	hostStr := fmt.Sprintf("%s:%d", config.HostBindAddress, config.PortNumber)
-	fmt.Printf("Starting server, listening to port %s...\n", hostStr)
-	listener, err := net.Listen("tcp", hostStr)
-	fail(err)
+	logger.Infof("Starting server, listening to port %s...", hostStr)
+	var listener net.Listener
+	var err error
+	if config.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		fail(err)
+		logger.Infof("TLS certificate fingerprint (the TLSPin for client server profiles): %s", certFingerprint(cert.Certificate[0]))
+		listener, err = tls.Listen("tcp", hostStr, &tls.Config{Certificates: []tls.Certificate{cert}})
+		fail(err)
+	} else {
+		listener, err = net.Listen("tcp", hostStr)
+		fail(err)
+	}
 
 	defer listener.Close()
 
 	for {
 		connection, err := listener.Accept()
 		if err != nil {
-			log.Printf("%v\n", err)
+			warn(err)
 			continue
 		}
 
-		// If you want, you can increment a counter here and inject to handleClientRequest below as client identifier
-		go handleClientRequest(connection, config)
+		// each connection gets its own ID in the log
+		go handleClientRequest(connection, logger.withRequestID(nextRequestID()), config)
 	}
 }
 
-func handleClientRequest(conx net.Conn, config ServerConfig) {
+var requestCounter uint64
+
+// numbers client requests (both TCP and HTTP) so that their log messages can be told apart
+func nextRequestID() string {
+	return fmt.Sprintf("%d", atomic.AddUint64(&requestCounter, 1))
+}
+
+func handleClientRequest(conx net.Conn, rlog Logger, config ServerConfig) {
+	metrics.connectionOpened()
+	defer metrics.connectionClosed()
 	defer conx.Close()
+	defer func() {
+		// a bug in handling one request must not take down the whole server
+		if r := recover(); r != nil {
+			rlog.Errorf("Panic while handling a request from client %s: %v\n%s", conx.RemoteAddr().String(), r, debug.Stack())
+			conx.Write(strToUtf8(fmt.Sprintf("%s: Internal server error\n", RESP_ERROR)))
+		}
+	}()
 
 	clientReader := bufio.NewReader(conx)
 
 	// Waiting for the client message
 	msg, err := clientReader.ReadString('\n')
-	fmt.Printf("received %v", msg)
+	if err == nil && strings.HasPrefix(msg, COM_AUTH+":") {
+		// the password comes first, on a line of its own
+		password := strings.TrimSuffix(strings.TrimPrefix(msg, COM_AUTH+":"), "\n")
+		if config.Password != "" && subtle.ConstantTimeCompare([]byte(strings.TrimSuffix(password, "\r")), []byte(config.Password)) != 1 {
+			e := errors.New("Wrong server password")
+			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, e)))
+			rlog.Warnf("Client %s gave the wrong password", conx.RemoteAddr().String())
+			return
+		}
+		msg, err = clientReader.ReadString('\n')
+	} else if err == nil && config.Password != "" {
+		e := errors.New("This server needs a password")
+		conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, e)))
+		rlog.Warnf("Client %s did not give a password", conx.RemoteAddr().String())
+		return
+	}
+	rlog.Debugf("Received '%s' from client %s", strings.TrimSpace(msg), conx.RemoteAddr().String())
 
 	if err == io.EOF {
 		// client closed the connection
-		log.Print("Client closed the connection")
+		rlog.Debugf("Client closed the connection")
 		return
 	} else if err != nil {
-		log.Printf("%v\n", err)
+		rlog.Warn(err)
 		return
 	}
 
 	// Responding to the client message
 	msg = strings.TrimSpace(msg)
-	if msg == COM_CONCHECK {
+	req, err := parseRequest(msg, func(worldName string) bool {
+		_, exists := getStatus(worldName)
+		return exists
+	})
+	if err != nil {
+		conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
+		rlog.Warnf("Invalid request from client %s: %v", conx.RemoteAddr().String(), err)
+		return
+	}
+	if req.Command == COM_CONCHECK {
 		_, err = conx.Write(strToUtf8(fmt.Sprintf("%s\n", RESP_CONCHECK)))
-		warn(err)
-	} else if strings.HasPrefix(msg, COM_STATUS) {
-		fmt.Printf("Client %s requested status of all worlds\n", conx.RemoteAddr().String())
+		rlog.Warn(err)
+	} else if req.Command == COM_STATUS {
+		rlog.Infof("Client %s requested status of all worlds", conx.RemoteAddr().String())
 		// client requests list of worlds and their statuses
-		jstr, err := json.Marshal(statusSnapshot(false))
-		warn(err)
+		jstr, err := json.Marshal(worldListing(config))
+		rlog.Warn(err)
 		_, err = conx.Write(jstr)
-		warn(err)
-	} else if strings.HasPrefix(msg, COM_RELEASE) {
-		sp := strings.SplitN(msg, ":", 4)
-		overseer := sp[1]
-		worldName := sp[2]
-		magicRunes := sp[3]
-		fmt.Printf("Client %s requested that world %s revert to last check-in\n", conx.RemoteAddr().String(), worldName)
-		tok, exists := getStatus(worldName)
-		if !exists {
-			e := errors.New(fmt.Sprintf("No world named '%s'", worldName))
-			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, e)))
-			warn(e)
+		rlog.Warn(err)
+	} else if req.Command == COM_EXTEND {
+		overseer := req.Overseer
+		worldName := req.World
+		magicRunes := req.MagicRunes
+		ev := newEvent(EVENT_EXTEND, worldName, overseer, conx.RemoteAddr().String())
+		defer logEvent(ev, config)
+		rlog.Infof("Overseer %s from client %s requested more time for world %s", overseer, conx.RemoteAddr().String(), worldName)
+		newToken, err := extendCheckOut(worldName, overseer, magicRunes, config)
+		if err != nil {
+			ev.failed(err)
+			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
+			rlog.Warn(err)
 			return
 		}
-		if tok.MagicRunes == magicRunes {
-			// valid overseer
-			err = checkIn(worldName, overseer, config)
-			if err != nil {
-				conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-				warn(err)
-				return
-			}
+		tjstr, _ := json.Marshal(newToken)
+		conx.Write(strToUtf8(fmt.Sprintf("%s\n", RESP_SUCCESS)))
+		conx.Write(tjstr)
+		conx.Write(strToUtf8("\n"))
+	} else if req.Command == COM_UNRESERVE || req.Command == COM_RESERVE {
+		overseer := req.Overseer
+		worldName := req.World
+		ev := newEvent(EVENT_UNRESERVE, worldName, overseer, conx.RemoteAddr().String())
+		defer logEvent(ev, config)
+		if req.Command == COM_RESERVE {
+			ev.Type = EVENT_RESERVE
+			rlog.Infof("Overseer %s from client %s requested to reserve world %s", overseer, conx.RemoteAddr().String(), worldName)
+			err = joinQueue(worldName, overseer, config)
 		} else {
-			e := errors.New(fmt.Sprintf("Overseer %s is not the currect holder of world %s", overseer, worldName))
-			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, e)))
-			warn(e)
-			return
+			rlog.Infof("Overseer %s from client %s cancelled their reservation for world %s", overseer, conx.RemoteAddr().String(), worldName)
+			err = leaveQueue(worldName, overseer, config)
 		}
-	} else if strings.HasPrefix(msg, COM_CHECKOUT) {
-		sp := strings.Split(msg, ":")
-		if len(sp) != 3 {
-			e := errors.New(fmt.Sprintf("%s:%s '%s'\n", RESP_ERROR, "Invalid Check-out command", msg))
-			conx.Write(strToUtf8(fmt.Sprintf("%v", e)))
-			warn(e)
+		if err != nil {
+			ev.failed(err)
+			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
+			rlog.Warn(err)
 			return
 		}
-		overseer := sp[1]
-		worldName := sp[2]
-		fmt.Printf("Overseer %s from client %s requested to check-out world %s\n", overseer, conx.RemoteAddr().String(), worldName)
-		wFilePath := filepath.Join(config.WorldSaveFolder, fmt.Sprintf("%s.zip", worldName))
-		tok, exists := getStatus(worldName)
-		jsdbg, _ := json.MarshalIndent(tok, "", " ")
-		fmt.Printf("Current status token for %s:\n%s\n", worldName, string(jsdbg))
-		if !exists {
-			e := errors.New(fmt.Sprintf("No world named '%s'", worldName))
-			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, e)))
-			warn(e)
+		conx.Write(strToUtf8(fmt.Sprintf("%s\n", RESP_SUCCESS)))
+	} else if req.Command == COM_PEEK {
+		overseer := req.Overseer
+		worldName := req.World
+		revision := req.Revision
+		ev := newEvent(EVENT_PEEK, worldName, overseer, conx.RemoteAddr().String())
+		defer logEvent(ev, config)
+		rlog.Infof("Overseer %s from client %s requested a read-only copy of world %s %s", overseer, conx.RemoteAddr().String(), worldName, revision)
+		peekPath, snap, err := peekWorld(worldName, overseer, revision, config)
+		if err != nil {
+			ev.failed(err)
+			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
+			rlog.Warn(err)
 			return
-		} else if !fileExists(wFilePath) {
-			e := errors.New(fmt.Sprintf("File '%s' not found", wFilePath))
-			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, e)))
-			warn(e)
+		}
+		defer os.Remove(peekPath)
+		hash, err := hashFile(peekPath)
+		if err != nil {
+			ev.failed(err)
+			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
+			rlog.Warn(err)
 			return
-		} else if tok.Status != STATUS_AVAILABLE {
-			// checked-out or otherwise unavailable
-			e := errors.New(fmt.Sprintf("World named '%s' cannot be checked-out because it's unavailable (status == %s)", worldName, tok.Status))
-			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, e)))
-			warn(e)
+		}
+		fstat, err := os.Stat(peekPath)
+		if err != nil {
+			ev.failed(err)
+			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
+			rlog.Warn(err)
 			return
-		} else {
-			// Can check-out!
-			fmt.Printf("Checking out world %s...\n", worldName)
-			fmt.Printf("Hashing file...")
-			hash, err := hashFile(wFilePath)
-			fmt.Printf(" hash = '%s'\n", hash)
-			if err != nil {
-				conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-				warn(err)
-				return
-			}
-			fstat, err := os.Stat(wFilePath)
-			if err != nil {
-				conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-				warn(err)
-				return
-			}
-			fileSize := fstat.Size()
-			// make sure the file is there
-			fmt.Printf("Reading file %s\n", wFilePath)
-			//buf := make([]byte, 0x100000)
-			zipFileSrc, err := os.Open(wFilePath)
-			if err != nil {
-				conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-				warn(err)
-				return
-			}
-			// update the lock token
-			fmt.Printf("Setting lock token to Downlaod\n")
-			downloadLock := tok
-			downloadLock.CurrentOverseer = overseer
-			downloadLock.Status = STATUS_DOWNLOADING
-			dd, err := time.ParseDuration(config.DownloadTimeLimit)
-			if err != nil {
-				conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-				warn(err)
-				return
-			}
-			cd, err := time.ParseDuration(config.CheckOutTimeLimit)
-			if err != nil {
-				conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-				warn(err)
-				return
-			}
-			downloadLock.Expires = time.Now().Add(dd).Format(time.RFC3339)
-			downloadLock.MagicRunes = newMagicRunes()
-			oldStatus, _ := setStatus(worldName, downloadLock, config)
-			if oldStatus.Status != STATUS_AVAILABLE {
-				// Oops! Thread race accident! Clean-up!
-				setStatus(worldName, oldStatus, config)
-				conx.Write(strToUtf8(fmt.Sprintf("%s: %s\n", RESP_ERROR, fmt.Sprintf("World named '%s' cannot be checked-out because it's unavailable (status == %s)", worldName, oldStatus.Status))))
-				return
-			}
-			// prepare the checkout token (a copy will be sent to the client)
-			checkoutToken := downloadLock
-			checkoutToken.Status = STATUS_CHECKOUT
-			checkoutToken.Expires = time.Now().Add(cd).Format(time.RFC3339)
-			tjstr, err := json.Marshal(checkoutToken)
-			if err != nil {
-				conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-				warn(err)
-				return
-			}
-			// finally, do the file transfer
-			fmt.Printf("Transmitting download response...\n")
-			conx.Write(strToUtf8(fmt.Sprintf("%s\n", RESP_DOWNLOAD)))
-			fmt.Printf("Transmitting token '%s'...\n", tjstr)
-			conx.Write(tjstr)
-			conx.Write(strToUtf8("\n"))
-			fmt.Printf("Transmitting file hash...\n")
-			conx.Write(strToUtf8(fmt.Sprintf("%s\n", hash)))
-			fmt.Printf("Transmitting file data...\n")
-			//io.CopyBuffer(conx, zipFileSrc, buf)
-			err = sendFile(zipFileSrc, conx, fileSize, false)
-			if err != nil {
-				warn(err)
-				err2 := checkIn(worldName, overseer, config)
-				if err2 != nil {
-					warn(err2)
-				}
-				conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-				return
-			}
-			_, err = setStatus(worldName, checkoutToken, config)
-			if err != nil {
-				conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-				warn(err)
-				return
-			} else {
-				conx.Write(strToUtf8(fmt.Sprintf("%s\n", RESP_SUCCESS)))
-			}
-			writeHistoryLine(time.Now(), worldName, overseer, fmt.Sprintf("World pulled from the cosmic aether by overseer %s", overseer), config)
-			fmt.Printf("...checkout done\n")
 		}
-		return
-	} else if strings.HasPrefix(msg, COM_CHECKIN) {
-		sp := strings.SplitN(msg, ":", 4)
-		overseer := sp[1]
-		worldName := sp[2]
-		magicRunes := sp[3]
-		fmt.Printf("Overseer %s from client %s requested to check-in world %s\n", overseer, conx.RemoteAddr().String(), worldName)
-		// first, check if client has permission to check-in this world
-		lok, exists := getStatus(worldName)
-		if !exists {
-			err = errors.New(fmt.Sprintf("World %s does not exist on server", worldName))
+		peekFile, err := os.Open(peekPath)
+		if err != nil {
+			ev.failed(err)
 			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-			warn(err)
+			rlog.Warn(err)
 			return
 		}
-		if lok.Status == STATUS_AVAILABLE {
-			err = errors.New(fmt.Sprintf("World %s cannot be checked in because it has already been checked in", worldName))
+		defer peekFile.Close()
+		ev.Revision = hash
+		sjstr, _ := json.Marshal(snap)
+		conx.Write(strToUtf8(fmt.Sprintf("%s\n", RESP_DOWNLOAD)))
+		conx.Write(sjstr)
+		conx.Write(strToUtf8("\n"))
+		conx.Write(strToUtf8(fmt.Sprintf("%s\n", hash)))
+		err = sendFile(peekFile, conx, fstat.Size(), false)
+		if err != nil {
+			ev.failed(err)
+			rlog.Warn(err)
+			return
+		}
+		ev.Bytes = fstat.Size()
+		rlog.Infof("...read-only copy of %s sent", worldName)
+	} else if req.Command == COM_RELEASE {
+		overseer := req.Overseer
+		worldName := req.World
+		magicRunes := req.MagicRunes
+		ev := newEvent(EVENT_RELEASE, worldName, overseer, conx.RemoteAddr().String())
+		defer logEvent(ev, config)
+		rlog.Infof("Client %s requested that world %s revert to last check-in", conx.RemoteAddr().String(), worldName)
+		err = releaseWorld(worldName, overseer, magicRunes, config)
+		if err != nil {
+			ev.failed(err)
 			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-			warn(err)
+			rlog.Warn(err)
 			return
 		}
-		if lok.MagicRunes != magicRunes {
-			err = errors.New(fmt.Sprintf("Overseer %s is not the currect holder of world %s", overseer, worldName))
+	} else if req.Command == COM_CHECKOUT {
+		overseer := req.Overseer
+		worldName := req.World
+		clientDFVersion := req.DFVersion
+		clientSaveFormat := req.SaveFormat
+		ev := newEvent(EVENT_CHECKOUT, worldName, overseer, conx.RemoteAddr().String())
+		defer logEvent(ev, config)
+		rlog.Infof("Overseer %s from client %s requested to check-out world %s", overseer, conx.RemoteAddr().String(), worldName)
+		co, err := beginCheckOut(worldName, overseer, clientDFVersion, clientSaveFormat, config)
+		if err != nil {
+			ev.failed(err)
 			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-			warn(err)
+			rlog.Warn(err)
 			return
 		}
-		// next, tell client that they may check-in
-		fmt.Printf("Permission granted for check-in\n")
-		conx.Write(strToUtf8(fmt.Sprintf("%s\n", RESP_UPLOAD)))
-		// next, read the upload file hash
-		fmt.Printf("Reading upload file hash...\n")
-		msg, err = clientReader.ReadString('\n')
+		ev.Revision = co.Hash
+		zipFileSrc, err := os.Open(co.ZipPath)
 		if err != nil {
+			abortCheckOut(co, config)
 			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-			warn(err)
+			rlog.Warn(err)
 			return
 		}
-		hash := strings.TrimSpace(msg)
-		fmt.Printf("%s\n", hash)
-		// now read the file from the client
-		tmpFilePath := filepath.Join(config.TempFolder, fmt.Sprintf("CloudFort-upload-%s.temp", worldName))
-		fmt.Printf("Receiving file data to temp file %s\n", tmpFilePath)
-		defer os.Remove(tmpFilePath)
-		tmpFile, err := os.OpenFile(tmpFilePath, os.O_WRONLY|os.O_CREATE, 0664)
+		defer zipFileSrc.Close()
+		tjstr, err := json.Marshal(co.clientToken())
 		if err != nil {
+			abortCheckOut(co, config)
 			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-			warn(err)
+			rlog.Warn(err)
 			return
 		}
-		//buf := make([]byte, 0x100000)
-		//_, err = io.CopyBuffer(tmpFile, clientReader, buf)
-		err = recvFile(clientReader, tmpFile, false)
+		// finally, do the file transfer
+		rlog.Debugf("Transmitting check-out token, file hash and file data...")
+		conx.Write(strToUtf8(fmt.Sprintf("%s\n", RESP_DOWNLOAD)))
+		conx.Write(tjstr)
+		conx.Write(strToUtf8("\n"))
+		conx.Write(strToUtf8(fmt.Sprintf("%s\n", co.Hash)))
+		err = sendFile(zipFileSrc, conx, co.Size, false)
 		if err != nil {
+			ev.failed(err)
+			rlog.Warn(err)
+			abortCheckOut(co, config)
 			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-			warn(err)
 			return
 		}
-		err = tmpFile.Close()
+		err = finishCheckOut(co, config)
 		if err != nil {
+			ev.failed(err)
 			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-			warn(err)
+			rlog.Warn(err)
+			return
+		}
+		ev.Bytes = co.Size
+		conx.Write(strToUtf8(fmt.Sprintf("%s\n", RESP_SUCCESS)))
+		rlog.Infof("...checkout done")
+		return
+	} else if req.Command == COM_CHECKIN {
+		overseer := req.Overseer
+		worldName := req.World
+		magicRunes := req.MagicRunes
+		rlog.Infof("Overseer %s from client %s requested to check-in world %s", overseer, conx.RemoteAddr().String(), worldName)
+		if checkInDone(worldName, overseer, req.OpID, config) {
+			// the client is retrying a check-in that went through, but it did not hear back the first time
+			// (this is not logged as another check-in)
+			rlog.Infof("Check-in %s of world %s was already completed", req.OpID, worldName)
+			conx.Write(strToUtf8(fmt.Sprintf("%s\n", RESP_SUCCESS)))
 			return
 		}
-		// check the hash to make sure the file is good
-		tmpHash, err := hashFile(tmpFilePath)
+		ev := newEvent(EVENT_CHECKIN, worldName, overseer, conx.RemoteAddr().String())
+		defer logEvent(ev, config)
+		// first, check if client has permission to check-in this world
+		err = authorizeCheckIn(worldName, overseer, magicRunes)
 		if err != nil {
+			ev.failed(err)
 			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-			warn(err)
+			rlog.Warn(err)
 			return
 		}
-		fmt.Printf("Hash check:\n%s <- transmitted hash\n%s <- actual hash\n", hash, tmpHash)
-		if hash != tmpHash {
-			err = errors.New(fmt.Sprintf("File hash mis-match"))
+		// next, tell client that they may check-in
+		rlog.Debugf("Permission granted for check-in")
+		tmpFilePath, hash, err := receiveUpload(conx, clientReader, worldName, ev, rlog, config)
+		if tmpFilePath != "" {
+			defer os.Remove(tmpFilePath)
+		}
+		if err != nil {
+			ev.failed(err)
 			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-			warn(err)
+			rlog.Warn(err)
 			return
 		}
-		// data is good!
-		// now replace save zip with files from new one
-		wFilePath := filepath.Join(config.WorldSaveFolder, fmt.Sprintf("%s.zip", worldName))
-		backupPath := fmt.Sprintf("%s.backup", wFilePath)
-		err = os.Rename(wFilePath, backupPath) // backup existing save incase we need to undo
+		err = acceptCheckIn(worldName, overseer, magicRunes, tmpFilePath, hash, req.OpID, config)
 		if err != nil {
+			ev.failed(err)
 			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-			warn(err)
+			rlog.Warn(err)
 			return
 		}
-		err = copySave(tmpFilePath, wFilePath, config)
+		// success!
+		rlog.Infof("Check-in sucessful!")
+		conx.Write(strToUtf8(fmt.Sprintf("%s\n", RESP_SUCCESS)))
+	} else if req.Command == COM_CHECKPOINT {
+		overseer := req.Overseer
+		worldName := req.World
+		ev := newEvent(EVENT_CHECKPOINT, worldName, overseer, conx.RemoteAddr().String())
+		defer logEvent(ev, config)
+		rlog.Infof("Overseer %s from client %s requested to checkpoint world %s", overseer, conx.RemoteAddr().String(), worldName)
+		// only the holder of the check-out may upload a checkpoint
+		err = authorizeCheckIn(worldName, overseer, req.MagicRunes)
 		if err != nil {
-			os.Rename(backupPath, wFilePath)
+			ev.failed(err)
 			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-			warn(err)
+			rlog.Warn(err)
 			return
 		}
-		// finally mark the world as checked-in
-		err = checkIn(worldName, overseer, config)
+		tmpFilePath, hash, err := receiveUpload(conx, clientReader, worldName, ev, rlog, config)
+		if tmpFilePath != "" {
+			defer os.Remove(tmpFilePath)
+		}
+		if err == nil {
+			err = acceptCheckpoint(worldName, overseer, req.MagicRunes, tmpFilePath, hash, config)
+		}
 		if err != nil {
+			ev.failed(err)
 			conx.Write(strToUtf8(fmt.Sprintf("%s: %v\n", RESP_ERROR, err)))
-			warn(err)
+			rlog.Warn(err)
 			return
 		}
-		// success!
-		fmt.Printf("Check-in sucessful!\n")
+		rlog.Infof("Checkpoint saved")
 		conx.Write(strToUtf8(fmt.Sprintf("%s\n", RESP_SUCCESS)))
+	} else {
+		// command not recognized
+		rlog.Warn(errors.New(fmt.Sprintf("Command %s not recognized", msg)))
+	}
+	// done
+}
+
+// tells the client to go ahead with an upload, then reads the hash and the file it sends into a temp file
+// returns the path of the temp file (for the caller to remove, even if there was an error) and the hash
+func receiveUpload(conx net.Conn, clientReader *bufio.Reader, worldName string, ev *Event, rlog Logger, config ServerConfig) (string, string, error) {
+	conx.Write(strToUtf8(fmt.Sprintf("%s\n", RESP_UPLOAD)))
+	// next, read the upload file hash
+	msg, err := clientReader.ReadString('\n')
+	if err != nil {
+		return "", "", err
+	}
+	hash := strings.TrimSpace(msg)
+	ev.Revision = hash
+	rlog.Debugf("Upload file hash: %s", hash)
+	// now read the file from the client
+	tmpFile, err := os.CreateTemp(config.TempFolder, fmt.Sprintf("CloudFort-upload-%s.*.temp", worldName))
+	if err != nil {
+		return "", hash, err
+	}
+	tmpFilePath := tmpFile.Name()
+	rlog.Debugf("Receiving file data to temp file %s", tmpFilePath)
+	err = recvFile(clientReader, tmpFile, false)
+	if err != nil {
+		tmpFile.Close()
+		return tmpFilePath, hash, err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return tmpFilePath, hash, err
+	}
+	if fstat, err := os.Stat(tmpFilePath); err == nil {
+		ev.Bytes = fstat.Size()
+	}
+	return tmpFilePath, hash, nil
+}
+
+// a check-out that has been approved, but not yet downloaded by the client
+type pendingCheckOut struct {
+	World    string
+	Overseer string
+	Token    LockToken // the token for the client, with status checked-out
+	Files    []string  // the world's SaveFiles patterns, sent with the token
+	ZipPath  string
+	Hash     string
+	Size     int64
+}
+
+// checks that an overseer may check-out a world and locks the world while it is downloaded
+// the caller must then call either finishCheckOut or abortCheckOut
+func beginCheckOut(worldName string, overseer string, clientDFVersion string, clientSaveFormat uint32, config ServerConfig) (pendingCheckOut, error) {
+	var co pendingCheckOut
+	wFilePath := filepath.Join(config.WorldSaveFolder, fmt.Sprintf("%s.zip", worldName))
+	tok, exists := getStatus(worldName)
+	if !exists {
+		return co, errors.New(fmt.Sprintf("No world named '%s'", worldName))
+	} else if !fileExists(wFilePath) {
+		return co, errors.New(fmt.Sprintf("File '%s' not found", wFilePath))
+	}
+	wconf, err := loadWorldConfig(worldName, config)
+	if err != nil {
+		return co, err
+	}
+	if tok.Status != STATUS_AVAILABLE {
+		// checked-out or otherwise unavailable
+		return co, errors.New(fmt.Sprintf("World named '%s' cannot be checked-out because it's unavailable (status == %s)", worldName, tok.Status))
+	} else if holder, until := reservation(worldName); holder != "" && holder != overseer {
+		return co, errors.New(fmt.Sprintf("World named '%s' is reserved for overseer %s until %s", worldName, holder, until))
+	} else if !wconf.allowsOverseer(overseer) {
+		return co, errors.New(fmt.Sprintf("Overseer %s is not allowed to check-out world '%s'", overseer, worldName))
+	} else if err := checkDFCompatibility(worldName, clientDFVersion, clientSaveFormat, wconf); err != nil {
+		return co, err
+	}
+	// Can check-out!
+	logger.Infof("Checking out world %s...", worldName)
+	hash, err := hashFile(wFilePath)
+	logger.Debugf("Hash of %s = '%s'", wFilePath, hash)
+	if err != nil {
+		return co, err
+	}
+	fstat, err := os.Stat(wFilePath)
+	if err != nil {
+		return co, err
+	}
+	dd, err := time.ParseDuration(wconf.DownloadTimeLimit)
+	if err != nil {
+		return co, err
+	}
+	cd, err := time.ParseDuration(wconf.CheckOutTimeLimit)
+	if err != nil {
+		return co, err
+	}
+	// update the lock token
+	downloadLock := tok
+	downloadLock.CurrentOverseer = overseer
+	downloadLock.Status = STATUS_DOWNLOADING
+	downloadLock.Expires = time.Now().Add(dd).Format(time.RFC3339)
+	downloadLock.MagicRunes = newMagicRunes()
+	oldStatus, _ := setStatus(worldName, downloadLock, config)
+	if oldStatus.Status != STATUS_AVAILABLE {
+		// Oops! Thread race accident! Clean-up!
+		setStatus(worldName, oldStatus, config)
+		return co, errors.New(fmt.Sprintf("World named '%s' cannot be checked-out because it's unavailable (status == %s)", worldName, oldStatus.Status))
+	}
+	// prepare the checkout token (a copy will be sent to the client)
+	checkoutToken := downloadLock
+	checkoutToken.Status = STATUS_CHECKOUT
+	checkoutToken.Expires = time.Now().Add(cd).Format(time.RFC3339)
+	checkoutToken.CheckedOut = time.Now().Format(time.RFC3339)
+	co = pendingCheckOut{
+		World:    worldName,
+		Overseer: overseer,
+		Token:    checkoutToken,
+		Files:    wconf.SaveFiles,
+		ZipPath:  wFilePath,
+		Hash:     hash,
+		Size:     fstat.Size(),
+	}
+	return co, nil
+}
+
+// the token sent to the client, with the world's SaveFiles patterns so that every overseer packs the same files
+func (co pendingCheckOut) clientToken() LockToken {
+	token := co.Token
+	token.SaveFiles = co.Files
+	return token
+}
+
+// marks a world as checked-out once the client has downloaded it
+func finishCheckOut(co pendingCheckOut, config ServerConfig) error {
+	_, err := setStatus(co.World, co.Token, config)
+	if err != nil {
+		return err
+	}
+	writeHistoryLine(time.Now(), co.World, co.Overseer, fmt.Sprintf("World pulled from the cosmic aether by overseer %s", co.Overseer), config)
+	warn(leaveQueue(co.World, co.Overseer, config))
+	return nil
+}
+
+// makes a world available again after a failed download
+func abortCheckOut(co pendingCheckOut, config ServerConfig) {
+	err := checkIn(co.World, co.Overseer, config)
+	if err != nil {
+		warn(err)
+	}
+}
+
+// checks that the overseer presenting the magic runes is allowed to check-in a world
+func authorizeCheckIn(worldName string, overseer string, magicRunes string) error {
+	lok, exists := getStatus(worldName)
+	if !exists {
+		return errors.New(fmt.Sprintf("World %s does not exist on server", worldName))
+	}
+	if lok.Status == STATUS_AVAILABLE {
+		return errors.New(fmt.Sprintf("World %s cannot be checked in because it has already been checked in", worldName))
+	}
+	if lok.Status == STATUS_INVALID {
+		return errors.New(fmt.Sprintf("World %s cannot be checked in because it is invalid", worldName))
+	}
+	if lok.MagicRunes != magicRunes {
+		return errors.New(fmt.Sprintf("Overseer %s is not the currect holder of world %s", overseer, worldName))
+	}
+	return nil
+}
+
+// the last check-in of a world that came with an operation ID, kept in checkins.json in the server's state folder
+// so that a client retrying a check-in that already went through is told it succeeded
+type CompletedCheckIn struct {
+	OpID     string
+	Overseer string
+	Time     string
+}
+
+var checkInRecordLock sync.Mutex
+
+// whether the given check-in operation is the last one that was accepted for this world
+func checkInDone(worldName string, overseer string, opID string, config ServerConfig) bool {
+	if opID == "" {
+		return false
+	}
+	checkInRecordLock.Lock()
+	defer checkInRecordLock.Unlock()
+	records, err := loadCheckInRecords(config)
+	if err != nil {
+		warn(err)
+		return false
+	}
+	rec, ok := records[worldName]
+	return ok && rec.OpID == opID && rec.Overseer == overseer
+}
+
+func recordCheckIn(worldName string, overseer string, opID string, config ServerConfig) error {
+	if opID == "" {
+		return nil
+	}
+	checkInRecordLock.Lock()
+	defer checkInRecordLock.Unlock()
+	records, err := loadCheckInRecords(config)
+	if err != nil {
+		return err
+	}
+	records[worldName] = CompletedCheckIn{OpID: opID, Overseer: overseer, Time: time.Now().Format(time.RFC3339)}
+	jstr, _ := json.MarshalIndent(records, "", "\t")
+	_, err = ensureDir(stateDir(config))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(stateFile("checkins.json", config), jstr, 0664)
+}
+
+func loadCheckInRecords(config ServerConfig) (map[string]CompletedCheckIn, error) {
+	records := make(map[string]CompletedCheckIn)
+	recordFile := stateFile("checkins.json", config)
+	if !fileExists(recordFile) {
+		return records, nil
+	}
+	jstr, err := ioutil.ReadFile(recordFile)
+	if err != nil {
+		return records, err
+	}
+	err = json.Unmarshal(jstr, &records)
+	if err != nil {
+		return records, errors.Wrapf(err, "Failed to parse %s", recordFile)
+	}
+	return records, nil
+}
+
+// replaces the save of a checked-out world with an uploaded zip file and makes the world available again
+// (if hash is "", the hash check is skipped; opID is the client's operation ID, if it sent one)
+func acceptCheckIn(worldName string, overseer string, magicRunes string, uploadPath string, hash string, opID string, config ServerConfig) error {
+	err := authorizeCheckIn(worldName, overseer, magicRunes)
+	if err != nil {
+		return err
+	}
+	// check the hash to make sure the file is good
+	if hash != "" {
+		tmpHash, err := hashFile(uploadPath)
+		if err != nil {
+			return err
+		}
+		logger.Debugf("Hash check: %s <- transmitted hash, %s <- actual hash", hash, tmpHash)
+		if hash != tmpHash {
+			metrics.recordHashMismatch()
+			return errors.New(fmt.Sprintf("File hash mis-match"))
+		}
+	}
+	wconf, err := loadWorldConfig(worldName, config)
+	if err != nil {
+		return err
+	}
+	report, _ := validateSaveZip(uploadPath, sizeLimitBytes(wconf.WorldSizeLimitMB), wconf.SaveFiles)
+	if !report.IsValid() {
+		return errors.New(fmt.Sprintf("Uploaded save is not valid: %s", strings.Join(report.Problems, "; ")))
+	}
+	// data is good!
+	err = replaceSave(worldName, uploadPath, config)
+	if err != nil {
+		return err
+	}
+	// the operation ID is recorded while the world is still checked-out, so that a retry can't find it available
+	// without knowing that its check-in went through
+	warn(recordCheckIn(worldName, overseer, opID, config))
+	// finally mark the world as checked-in
+	return checkIn(worldName, overseer, config)
+}
+
+// replaces the save zip of a world with the save files from another zip, keeping it as a new revision
+func replaceSave(worldName string, zipPath string, config ServerConfig) error {
+	wFilePath := filepath.Join(config.WorldSaveFolder, fmt.Sprintf("%s.zip", worldName))
+	backupPath := fmt.Sprintf("%s.backup", wFilePath)
+	err := os.Rename(wFilePath, backupPath) // backup existing save incase we need to undo
+	if err != nil {
+		return err
+	}
+	err = copySave(zipPath, wFilePath, config)
+	if err != nil {
+		os.Rename(backupPath, wFilePath)
+		return err
+	}
+	warn(refreshSaveInfo(worldName, config))
+	warn(archiveRevision(worldName, config))
+	return nil
+}
+
+// copies the current save of a world to its revisions folder, deleting the oldest revisions beyond RevisionsKept
+func archiveRevision(worldName string, config ServerConfig) error {
+	if config.RevisionsKept <= 0 {
+		return nil
+	}
+	revDir := filepath.Join(config.WorldSaveFolder, "revisions", worldName)
+	_, err := ensureDir(revDir)
+	if err != nil {
+		return err
+	}
+	wFilePath := filepath.Join(config.WorldSaveFolder, fmt.Sprintf("%s.zip", worldName))
+	revision := time.Now().UTC().Format(REVISION_TIME_FORMAT)
+	err = copyFile(wFilePath, filepath.Join(revDir, fmt.Sprintf("%s.zip", revision)))
+	if err != nil {
+		return err
+	}
+	revisions, err := listRevisions(worldName, config)
+	if err != nil {
+		return err
+	}
+	for i := config.RevisionsKept; i < len(revisions); i++ {
+		err = os.Remove(filepath.Join(revDir, fmt.Sprintf("%s.zip", revisions[i])))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lists the revisions of a world (named after the time they were checked-in), newest first
+func listRevisions(worldName string, config ServerConfig) ([]string, error) {
+	revDir := filepath.Join(config.WorldSaveFolder, "revisions", worldName)
+	if !fileExists(revDir) {
+		return []string{}, nil
+	}
+	zips, err := listFiles(revDir, ".zip")
+	if err != nil {
+		return nil, err
+	}
+	revisions := make([]string, 0, len(zips))
+	for _, z := range zips {
+		revisions = append(revisions, nameFromFile(z))
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(revisions)))
+	return revisions, nil
+}
+
+// returns the zip file of a world revision
+func revisionPath(worldName string, revision string, config ServerConfig) (string, error) {
+	if _, err := time.Parse(REVISION_TIME_FORMAT, revision); err != nil {
+		return "", errors.New(fmt.Sprintf("Invalid revision '%s'", revision))
+	}
+	revPath := filepath.Join(config.WorldSaveFolder, "revisions", worldName, fmt.Sprintf("%s.zip", revision))
+	if !fileExists(revPath) {
+		return "", errors.New(fmt.Sprintf("World %s has no revision %s", worldName, revision))
+	}
+	return revPath, nil
+}
+
+// copies the latest check-in (or a revision) of a world to a temp file for a spectator, without changing its status
+// the caller must delete the temp file
+func peekWorld(worldName string, overseer string, revision string, config ServerConfig) (string, Snapshot, error) {
+	snap := Snapshot{World: worldName, Revision: revision}
+	tok, exists := getStatus(worldName)
+	if !exists {
+		return "", snap, errors.New(fmt.Sprintf("No world named '%s'", worldName))
+	}
+	if tok.Status == STATUS_INVALID {
+		return "", snap, errors.New(fmt.Sprintf("World %s is not a valid save", worldName))
+	}
+	wconf, err := loadWorldConfig(worldName, config)
+	if err != nil {
+		return "", snap, err
+	}
+	if !*wconf.SpectatorDownloads {
+		return "", snap, errors.New(fmt.Sprintf("Spectators are not allowed to download world %s", worldName))
+	}
+	snap.SaveFiles = wconf.SaveFiles
+	srcPath := filepath.Join(config.WorldSaveFolder, fmt.Sprintf("%s.zip", worldName))
+	if revision != "" {
+		srcPath, err = revisionPath(worldName, revision, config)
+		if err != nil {
+			return "", snap, err
+		}
+	}
+	// copy first, so that a check-in can replace the world while the copy is being sent
+	tmpFile, err := os.CreateTemp(config.TempFolder, fmt.Sprintf("CloudFort-peek-%s.*.temp", worldName))
+	if err != nil {
+		return "", snap, err
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	err = copyFile(srcPath, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", snap, err
+	}
+	if info, err := readSaveInfo(tmpPath); err == nil {
+		snap.Info = &info
+	}
+	snap.Downloaded = time.Now().Format(time.RFC3339)
+	event := "Downloaded a read-only copy"
+	if revision != "" {
+		event = fmt.Sprintf("Downloaded a read-only copy of revision %s", revision)
+	}
+	err = writeHistoryLine(time.Now(), worldName, overseer, event, config)
+	warn(err)
+	return tmpPath, snap, nil
+}
 
-	} else {
-		// command not recognized
-		warn(errors.New(fmt.Sprintf("Command %s not recognized", msg)))
+// makes a checked-out world available again without changing its save
+func releaseWorld(worldName string, overseer string, magicRunes string, config ServerConfig) error {
+	tok, exists := getStatus(worldName)
+	if !exists {
+		return errors.New(fmt.Sprintf("No world named '%s'", worldName))
 	}
-	// done
+	if tok.Status != STATUS_DOWNLOADING && tok.Status != STATUS_CHECKOUT {
+		return errors.New(fmt.Sprintf("World %s is not checked-out", worldName))
+	}
+	if tok.MagicRunes != magicRunes {
+		return errors.New(fmt.Sprintf("Overseer %s is not the currect holder of world %s", overseer, worldName))
+	}
+	// valid overseer
+	return checkIn(worldName, overseer, config)
 }
 
 func expirationChecker(ticker *time.Ticker, done chan bool, config ServerConfig) {
@@ -371,23 +896,42 @@ func expirationChecker(ticker *time.Ticker, done chan bool, config ServerConfig)
 	for {
 		select {
 		case <-done:
-			fmt.Println("Experiation timer ticker terminated.")
+			logger.Infof("Experiation timer ticker terminated.")
 			return
 		case _ = <-ticker.C:
 			tnow := time.Now()
 			smap := statusSnapshot(true)
 			for world, token := range smap {
-				if token.Status != STATUS_AVAILABLE {
+				if token.Status == STATUS_AVAILABLE {
+					advanceQueue(world, tnow, config)
+				} else if token.Status != STATUS_INVALID {
 					expTime, err := time.Parse(time.RFC3339, token.Expires)
 					if err != nil {
 						warn(errors.Wrap(err, "Error parsing exipration date"))
 					}
+					if err == nil && token.Status == STATUS_CHECKOUT {
+						wconf, _ := loadWorldConfig(world, config)
+						expTime = checkOutExpiry(token, expTime, wconf)
+						remindIfExpiring(world, token, expTime, tnow, config)
+						// late check-ins are accepted until the grace period is over
+						grace, _ := time.ParseDuration(wconf.CheckInGracePeriod)
+						expTime = expTime.Add(grace)
+					}
 					if err != nil || tnow.After(expTime) {
-						fmt.Printf("Lock for world %s has expired. Resetting status to %s\n", world, STATUS_AVAILABLE)
+						logger.Infof("Lock for world %s has expired. Resetting status to %s", world, STATUS_AVAILABLE)
+						ev := newEvent(EVENT_ABORT, world, token.CurrentOverseer, "")
+						if token.Status == STATUS_CHECKOUT {
+							ev.Type = EVENT_EXPIRE
+							// (the event's revision is set if the world was set to a checkpoint instead of reverted)
+							ev.Revision, err = expireToCheckpoint(world, token, config)
+							warn(err)
+						}
 						err = checkIn(world, config.ServerOverseerName, config)
 						if err != nil {
+							ev.failed(err)
 							warn(errors.Wrapf(err, "Error checking-in world %s", world))
 						}
+						logEvent(ev, config)
 					}
 				}
 			}
@@ -395,43 +939,93 @@ func expirationChecker(ticker *time.Ticker, done chan bool, config ServerConfig)
 	}
 }
 
-func initialize() ServerConfig {
-	// init global variables
-	statusMap = make(map[string]LockToken)
-	fmt.Print("Loading configuration...")
-	// first, load the config settings (saving the default if there is no config file)
-	defaultConfig := ServerConfig{
-		CloudFortVersion:   CloudFortVersion,
-		DFVersion:          "0.47.05",
-		WorldSaveFolder:    "save",
-		CheckOutTimeLimit:  "8h",
-		DownloadTimeLimit:  "30m",
-		WorldSizeLimitMB:   256,
-		TempFolder:         "temp",
-		PortNumber:         13137,
-		HostBindAddress:    "0.0.0.0",
-		ServerOverseerName: "<Server>",
+// when a check-out expires under the world's current time limits: the expiration time that was set at check-out
+// (and by extensions), but no later than its MaxCheckOutTime (or CheckOutTimeLimit, if that is longer) allows,
+// in case the limits were lowered during the check-out
+func checkOutExpiry(token LockToken, expires time.Time, wconf WorldConfig) time.Time {
+	checkedOut, err := time.Parse(time.RFC3339, token.CheckedOut)
+	if err != nil {
+		// token from before check-out times were recorded
+		return expires
 	}
-	var config ServerConfig
+	limit, _ := time.ParseDuration(wconf.CheckOutTimeLimit)
+	if maxTime, _ := time.ParseDuration(wconf.MaxCheckOutTime); maxTime > limit {
+		limit = maxTime
+	}
+	if latest := checkedOut.Add(limit); expires.After(latest) {
+		return latest
+	}
+	return expires
+}
+
+// loads the config settings, saving the default if there is no config file
+func loadConfig() ServerConfig {
 	configFile := "server-config.json"
 	if !fileExists(configFile) {
-		fmt.Println("Config file does not exist. Creating a new one...")
-		jstr, _ := json.MarshalIndent(defaultConfig, "", "\t")
+		logger.Infof("Config file does not exist. Creating a new one...")
+		jstr, _ := json.MarshalIndent(defaultServerConfig(), "", "\t")
 		err := ioutil.WriteFile(configFile, jstr, 0664)
 		fail(err)
-		config = defaultConfig
-	} else {
+	}
+	return readConfig()
+}
+
+// reads server-config.json without creating it (the defaults are used if it does not exist), for the subcommands
+func readConfig() ServerConfig {
+	config := defaultServerConfig()
+	configFile := "server-config.json"
+	if fileExists(configFile) {
 		jstr, err := ioutil.ReadFile(configFile)
 		fail(err)
-		config = defaultConfig
 		err = json.Unmarshal(jstr, &config)
 		fail(err)
 	}
 	err := serverSanityCheck(config)
 	fail(err)
-	fmt.Println("Done.")
+	return config
+}
+
+func defaultServerConfig() ServerConfig {
+	return ServerConfig{
+		CloudFortVersion:   CloudFortVersion,
+		DFVersion:          "0.47.05",
+		WorldSaveFolder:    "save",
+		CheckOutTimeLimit:  "8h",
+		DownloadTimeLimit:  "30m",
+		WorldSizeLimitMB:   256,
+		RevisionsKept:      10,
+		SpectatorDownloads: false,
+		TempFolder:         "temp",
+		PortNumber:         13137,
+		HostBindAddress:    "0.0.0.0",
+		ServerOverseerName: "<Server>",
+		InvalidWorldAction: INVALID_MARK,
+		DFVersionPolicy:    DFVERSION_REFUSE,
+		MaxCheckOutTime:    "24h",
+		ExtensionTime:      "2h",
+		CheckInGracePeriod: "30m",
+		ReservationTime:    "2h",
+		Logging:            defaultLogConfig(""),
+		WebhookRetries:     5,
+		ExpirationAction:   EXPIRED_REVERT,
+		Email: EmailConfig{
+			SMTPPort:     587,
+			ReminderTime: "1h",
+		},
+	}
+}
+
+func initialize() ServerConfig {
+	// init global variables
+	statusMap = make(map[string]LockToken)
+	problemMap = make(map[string]string)
+	infoMap = make(map[string]SaveInfo)
+	queueMap = make(map[string]TurnQueue)
+	logger.Infof("Loading configuration...")
+	config := loadConfig()
+	fail(setupLogging(config.Logging))
 	// then make the directories
-	fmt.Print("Initializing folders...")
+	logger.Infof("Initializing folders...")
 	saveDir := config.WorldSaveFolder
 	newDir, err := ensureDir(saveDir)
 	fail(err)
@@ -443,21 +1037,30 @@ func initialize() ServerConfig {
 	}
 	_, err = ensureDir(config.TempFolder)
 	fail(err)
+	_, err = ensureDir(stateDir(config))
+	fail(err)
+	for _, name := range []string{"checkins.json", "overseers.json", "webhook-queue.json"} {
+		// (older versions kept them in the save folder itself)
+		oldPath := filepath.Join(saveDir, name)
+		if fileExists(oldPath) && !fileExists(stateFile(name, config)) {
+			logger.Infof("Moving %s to %s", oldPath, stateFile(name, config))
+			fail(os.Rename(oldPath, stateFile(name, config)))
+		}
+	}
 	historyFile := filepath.Join(config.WorldSaveFolder, "history.csv")
 	if !fileExists(historyFile) {
 		err := ioutil.WriteFile(historyFile, []byte("Time,World,Overseer,Event\n"), 0664)
 		fail(err)
 	}
-	fmt.Println("Done.")
-	// then mark any un-tracked (ie new) .zip files as checked-in
+	// then validate any un-tracked (ie new) .zip files and mark them as checked-in
 	zipFiles, err := listFiles(saveDir, ".zip")
 	fail(err)
+	imported := make(map[string]bool)
 	for _, f := range zipFiles {
-		worldName := nameFromFile(f)
 		lockFile := swapFileSuffix(f, ".dftk")
 		if !fileExists(lockFile) {
-			err = checkIn(worldName, config.ServerOverseerName, config)
-			warn(err)
+			importWorld(f, config)
+			imported[nameFromFile(f)] = true
 		}
 	}
 	// now read all .dftk files to sycronize world status
@@ -475,6 +1078,28 @@ func initialize() ServerConfig {
 		fail(err)
 		worldName := nameFromFile(f)
 		statusMap[worldName] = token
+		if (token.Status == STATUS_INVALID || !validWorldName(worldName)) && !imported[worldName] {
+			// check again, in case the zip file has been replaced with a good one
+			// (or to reject a world that was imported before its name was checked)
+			importWorld(zipFile, config)
+		}
+	}
+	// and the turn queues
+	queueFiles, err := listFiles(saveDir, ".dfq")
+	fail(err)
+	for _, f := range queueFiles {
+		jstr, err := ioutil.ReadFile(f)
+		fail(err)
+		var queue TurnQueue
+		err = json.Unmarshal(jstr, &queue)
+		fail(err)
+		queueMap[nameFromFile(f)] = queue
+	}
+	// read the save info (eg save format version) from each world
+	for worldName, token := range statusSnapshot(false) {
+		if token.Status != STATUS_INVALID {
+			warn(refreshSaveInfo(worldName, config))
+		}
 	}
 	// finally, return the config
 	return config
@@ -489,9 +1114,281 @@ func serverSanityCheck(c ServerConfig) error {
 	if err != nil {
 		return err
 	}
+	for _, d := range []string{c.MaxCheckOutTime, c.ExtensionTime, c.CheckInGracePeriod, c.ReservationTime} {
+		_, err = time.ParseDuration(d)
+		if err != nil {
+			return err
+		}
+	}
+	if c.InvalidWorldAction != INVALID_MARK && c.InvalidWorldAction != INVALID_QUARANTINE {
+		return errors.New(fmt.Sprintf("InvalidWorldAction must be '%s' or '%s', not '%s'", INVALID_MARK, INVALID_QUARANTINE, c.InvalidWorldAction))
+	}
+	if c.DFVersionPolicy != DFVERSION_REFUSE && c.DFVersionPolicy != DFVERSION_WARN && c.DFVersionPolicy != DFVERSION_IGNORE {
+		return errors.New(fmt.Sprintf("DFVersionPolicy must be '%s', '%s' or '%s', not '%s'", DFVERSION_REFUSE, DFVERSION_WARN, DFVERSION_IGNORE, c.DFVersionPolicy))
+	}
+	if c.ExpirationAction != EXPIRED_REVERT && c.ExpirationAction != EXPIRED_CHECKPOINT {
+		return errors.New(fmt.Sprintf("ExpirationAction must be '%s' or '%s', not '%s'", EXPIRED_REVERT, EXPIRED_CHECKPOINT, c.ExpirationAction))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("TLSCertFile and TLSKeyFile must both be set to use TLS")
+	}
+	err = webhookSanityCheck(c)
+	if err != nil {
+		return err
+	}
+	return emailSanityCheck(c)
+}
+
+// reads the settings for a world from its .json file (if it has one), using the server config for any missing settings
+func loadWorldConfig(worldName string, config ServerConfig) (WorldConfig, error) {
+	wconf := WorldConfig{
+		DFVersion:          config.DFVersion,
+		DFVersionPolicy:    config.DFVersionPolicy,
+		CheckOutTimeLimit:  config.CheckOutTimeLimit,
+		DownloadTimeLimit:  config.DownloadTimeLimit,
+		MaxCheckOutTime:    config.MaxCheckOutTime,
+		ExtensionTime:      config.ExtensionTime,
+		CheckInGracePeriod: config.CheckInGracePeriod,
+		ReservationTime:    config.ReservationTime,
+		WorldSizeLimitMB:   config.WorldSizeLimitMB,
+		SpectatorDownloads: &config.SpectatorDownloads,
+		ExpirationAction:   config.ExpirationAction,
+	}
+	configFile := filepath.Join(config.WorldSaveFolder, fmt.Sprintf("%s.json", worldName))
+	if !fileExists(configFile) {
+		return wconf, nil
+	}
+	jstr, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return wconf, err
+	}
+	var fileConf WorldConfig
+	err = json.Unmarshal(jstr, &fileConf)
+	if err != nil {
+		return wconf, errors.Wrapf(err, "Failed to parse %s", configFile)
+	}
+	wconf.Description = fileConf.Description
+	wconf.Mods = fileConf.Mods
+	wconf.AllowedOverseers = fileConf.AllowedOverseers
+	wconf.SaveFiles = fileConf.SaveFiles
+	if fileConf.DFVersion != "" {
+		wconf.DFVersion = fileConf.DFVersion
+	}
+	if fileConf.DFVersionPolicy != "" {
+		wconf.DFVersionPolicy = fileConf.DFVersionPolicy
+	}
+	if fileConf.CheckOutTimeLimit != "" {
+		wconf.CheckOutTimeLimit = fileConf.CheckOutTimeLimit
+	}
+	if fileConf.DownloadTimeLimit != "" {
+		wconf.DownloadTimeLimit = fileConf.DownloadTimeLimit
+	}
+	if fileConf.MaxCheckOutTime != "" {
+		wconf.MaxCheckOutTime = fileConf.MaxCheckOutTime
+	}
+	if fileConf.ExtensionTime != "" {
+		wconf.ExtensionTime = fileConf.ExtensionTime
+	}
+	if fileConf.CheckInGracePeriod != "" {
+		wconf.CheckInGracePeriod = fileConf.CheckInGracePeriod
+	}
+	if fileConf.ReservationTime != "" {
+		wconf.ReservationTime = fileConf.ReservationTime
+	}
+	if fileConf.WorldSizeLimitMB > 0 {
+		wconf.WorldSizeLimitMB = fileConf.WorldSizeLimitMB
+	}
+	if fileConf.SpectatorDownloads != nil {
+		wconf.SpectatorDownloads = fileConf.SpectatorDownloads
+	}
+	if fileConf.ExpirationAction != "" {
+		wconf.ExpirationAction = fileConf.ExpirationAction
+	}
+	return wconf, worldSanityCheck(wconf, configFile)
+}
+
+func worldSanityCheck(wc WorldConfig, configFile string) error {
+	durations := map[string]string{
+		"CheckOutTimeLimit":  wc.CheckOutTimeLimit,
+		"DownloadTimeLimit":  wc.DownloadTimeLimit,
+		"MaxCheckOutTime":    wc.MaxCheckOutTime,
+		"ExtensionTime":      wc.ExtensionTime,
+		"CheckInGracePeriod": wc.CheckInGracePeriod,
+		"ReservationTime":    wc.ReservationTime,
+	}
+	for name, d := range durations {
+		_, err := time.ParseDuration(d)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid %s in %s", name, configFile)
+		}
+	}
+	if wc.DFVersionPolicy != DFVERSION_REFUSE && wc.DFVersionPolicy != DFVERSION_WARN && wc.DFVersionPolicy != DFVERSION_IGNORE {
+		return errors.New(fmt.Sprintf("Invalid DFVersionPolicy '%s' in %s", wc.DFVersionPolicy, configFile))
+	}
+	if wc.ExpirationAction != EXPIRED_REVERT && wc.ExpirationAction != EXPIRED_CHECKPOINT {
+		return errors.New(fmt.Sprintf("Invalid ExpirationAction '%s' in %s", wc.ExpirationAction, configFile))
+	}
+	if err := checkSavePatterns(wc.SaveFiles); err != nil {
+		return errors.Wrapf(err, "Invalid SaveFiles in %s", configFile)
+	}
 	return nil
 }
 
+func (wc WorldConfig) allowsOverseer(overseer string) bool {
+	if len(wc.AllowedOverseers) == 0 {
+		return true
+	}
+	for _, name := range wc.AllowedOverseers {
+		if name == overseer {
+			return true
+		}
+	}
+	return false
+}
+
+// checks that the client's copy of DF can load a world (loading a save in the wrong DF version can corrupt it)
+// returns an error only if the check-out should be refused
+func checkDFCompatibility(worldName string, clientDFVersion string, clientSaveFormat uint32, wconf WorldConfig) error {
+	if wconf.DFVersionPolicy == DFVERSION_IGNORE {
+		return nil
+	}
+	var problem error
+	statusLock.Lock()
+	info, hasInfo := infoMap[worldName]
+	statusLock.Unlock()
+	if clientDFVersion == "" && clientSaveFormat == 0 {
+		warn(errors.New(fmt.Sprintf("Client did not report its DF version, cannot check compatibility with world %s", worldName)))
+		return nil
+	} else if clientDFVersion != "" && !sameDFVersion(clientDFVersion, wconf.DFVersion) {
+		problem = errors.New(fmt.Sprintf("World %s requires Dwarf Fortress version %s, but you have version %s", worldName, wconf.DFVersion, clientDFVersion))
+	} else if hasInfo && clientSaveFormat != 0 && clientSaveFormat < info.SaveFormat {
+		problem = errors.New(fmt.Sprintf("World %s was saved by a newer version of Dwarf Fortress than yours (save format %d > %d)", worldName, info.SaveFormat, clientSaveFormat))
+	}
+	if problem != nil && wconf.DFVersionPolicy == DFVERSION_WARN {
+		warn(problem)
+		return nil
+	}
+	return problem
+}
+
+// validates a new (or previously invalid) world save zip, making it available if it is a usable save
+func importWorld(zipPath string, config ServerConfig) {
+	worldName := nameFromFile(zipPath)
+	logger.Infof("Validating world save %s...", zipPath)
+	wconf, err := loadWorldConfig(worldName, config)
+	warn(err)
+	report, _ := validateSaveZip(zipPath, sizeLimitBytes(wconf.WorldSizeLimitMB), wconf.SaveFiles)
+	if !validWorldName(worldName) {
+		report.Problems = append(report.Problems, fmt.Sprintf(
+			"Clients can't use this world name (it is longer than %d bytes or contains : ; / \\ %% or a tab), rename the zip file", MAX_NAME_LENGTH))
+	}
+	for _, w := range report.Warnings {
+		warn(errors.New(fmt.Sprintf("World %s: %s", worldName, w)))
+	}
+	if report.IsValid() {
+		setProblem(worldName, "")
+		err := checkIn(worldName, config.ServerOverseerName, config)
+		warn(err)
+		if revisions, err := listRevisions(worldName, config); err == nil && len(revisions) == 0 {
+			// the imported save is the first revision
+			warn(archiveRevision(worldName, config))
+		}
+		return
+	}
+	reason := strings.Join(report.Problems, "; ")
+	warn(errors.New(fmt.Sprintf("World %s is not a valid save: %s", worldName, reason)))
+	if config.InvalidWorldAction == INVALID_QUARANTINE {
+		err := quarantineWorld(zipPath, reason, config)
+		warn(err)
+		return
+	}
+	token := LockToken{
+		Status:          STATUS_INVALID,
+		Expires:         time.Now().Format(time.RFC3339),
+		CurrentOverseer: config.ServerOverseerName,
+		MagicRunes:      "0",
+	}
+	setProblem(worldName, reason)
+	_, err = setStatus(worldName, token, config)
+	warn(err)
+	warn(writeHistoryLine(time.Now(), worldName, config.ServerOverseerName, fmt.Sprintf("World rejected as invalid: %s", reason), config))
+	logEvent(&Event{Type: EVENT_INVALID, World: worldName, Result: reason}, config)
+}
+
+// moves an invalid world save out of the save folder, along with a text file explaining why
+func quarantineWorld(zipPath string, reason string, config ServerConfig) error {
+	worldName := nameFromFile(zipPath)
+	qDir := filepath.Join(config.WorldSaveFolder, "quarantine")
+	_, err := ensureDir(qDir)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Moving invalid world %s to %s", worldName, qDir)
+	err = os.Rename(zipPath, filepath.Join(qDir, filepath.Base(zipPath)))
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(qDir, fmt.Sprintf("%s.txt", worldName)), []byte(reason+"\n"), 0664)
+	if err != nil {
+		return err
+	}
+	// forget about the world entirely
+	statusLock.Lock()
+	delete(statusMap, worldName)
+	delete(problemMap, worldName)
+	delete(infoMap, worldName)
+	statusLock.Unlock()
+	lockFile := swapFileSuffix(zipPath, ".dftk")
+	if fileExists(lockFile) {
+		err = os.Remove(lockFile)
+		if err != nil {
+			return err
+		}
+	}
+	logEvent(&Event{Type: EVENT_QUARANTINE, World: worldName, Result: reason}, config)
+	return writeHistoryLine(time.Now(), worldName, config.ServerOverseerName, fmt.Sprintf("World quarantined as invalid: %s", reason), config)
+}
+
+// reads the save info of a world, unless the zip file has not changed since the info was cached in its .dfinfo file
+func refreshSaveInfo(worldName string, config ServerConfig) error {
+	zipPath := filepath.Join(config.WorldSaveFolder, fmt.Sprintf("%s.zip", worldName))
+	infoFile := swapFileSuffix(zipPath, ".dfinfo")
+	revision, err := hashFile(zipPath)
+	if err != nil {
+		return err
+	}
+	var info SaveInfo
+	if fileExists(infoFile) {
+		jstr, err := ioutil.ReadFile(infoFile)
+		if err == nil && json.Unmarshal(jstr, &info) == nil && info.Revision == revision {
+			setSaveInfo(worldName, info)
+			return nil
+		}
+	}
+	logger.Infof("Reading save info for world %s", worldName)
+	info, err = readSaveInfo(zipPath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read save info for world %s", worldName)
+	}
+	info.Revision = revision
+	setSaveInfo(worldName, info)
+	jstr, _ := json.MarshalIndent(info, "", "\t")
+	return ioutil.WriteFile(infoFile, jstr, 0664)
+}
+
+func setSaveInfo(worldName string, info SaveInfo) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	infoMap[worldName] = info
+}
+
+func sizeLimitBytes(limitMB float64) uint64 {
+	if limitMB <= 0 {
+		return 0
+	}
+	return uint64(limitMB * 1024 * 1024)
+}
+
 func getStatus(worldName string) (LockToken, bool) {
 	// first, lock to prevent de-sync
 	statusLock.Lock()
@@ -508,10 +1405,11 @@ func setStatus(worldName string, newStatus LockToken, config ServerConfig) (Lock
 	// update map
 	oldToken := statusMap[worldName]
 	statusMap[worldName] = newStatus
+	metrics.recordStatusChange(newStatus.Status)
 	// save new state to file
 	lockFile := filepath.Join(config.WorldSaveFolder, fmt.Sprintf("%s.dftk", worldName))
 	jstr, _ := json.MarshalIndent(newStatus, "", "\t")
-	fmt.Printf("Setting status of %s to \n%s\n", worldName, jstr)
+	logger.Debugf("Setting status of %s to %s (overseer %s, expires %s)", worldName, newStatus.Status, newStatus.CurrentOverseer, newStatus.Expires)
 	err := ioutil.WriteFile(lockFile, jstr, 0664)
 	if err != nil {
 		return oldToken, err
@@ -536,6 +1434,56 @@ func statusSnapshot(showMagicRunes bool) map[string]LockToken {
 	return cp
 }
 
+func setProblem(worldName string, problem string) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	if problem == "" {
+		delete(problemMap, worldName)
+	} else {
+		problemMap[worldName] = problem
+	}
+}
+
+// like statusSnapshot, but includes extra information for the client (and never the magic runes)
+func worldListing(config ServerConfig) map[string]WorldStatus {
+	statusLock.Lock()
+	listing := make(map[string]WorldStatus)
+	for k, v := range statusMap {
+		v.MagicRunes = ""
+		ws := WorldStatus{
+			LockToken: v,
+			Problem:   problemMap[k],
+		}
+		if info, ok := infoMap[k]; ok {
+			ws.Info = &info
+		}
+		listing[k] = ws
+	}
+	statusLock.Unlock()
+	// then add the per-world settings (without holding the lock while reading files)
+	for k, ws := range listing {
+		wconf, err := loadWorldConfig(k, config)
+		warn(err)
+		ws.DFVersion = wconf.DFVersion
+		ws.Description = wconf.Description
+		ws.Mods = wconf.Mods
+		ws.Spectators = wconf.SpectatorDownloads != nil && *wconf.SpectatorDownloads
+		if cp, ok := loadCheckpoint(k, config); ok && ws.Status == STATUS_CHECKOUT {
+			ws.Checkpoint = cp.Time
+		}
+		statusLock.Lock()
+		queue := queueMap[k]
+		statusLock.Unlock()
+		ws.Queue = queue.Overseers
+		if len(queue.Overseers) > 0 && queue.ReservedUntil != "" {
+			ws.ReservedFor = queue.Overseers[0]
+			ws.ReservedUntil = queue.ReservedUntil
+		}
+		listing[k] = ws
+	}
+	return listing
+}
+
 func checkIn(worldName string, overseer string, config ServerConfig) error {
 	tnow := time.Now()
 	token := LockToken{
@@ -550,9 +1498,202 @@ func checkIn(worldName string, overseer string, config ServerConfig) error {
 		return err
 	}
 	err = writeHistoryLine(tnow, worldName, overseer, "World returned to the cosmic aether", config)
+	warn(startReservation(worldName, tnow, config))
+	// a checkpoint only matters while its check-out lasts
+	warn(removeCheckpoint(worldName, config))
+	forgetReminder(worldName)
 	return err
 }
 
+// gives the holder of a check-out more time, unless someone is waiting for their turn
+func extendCheckOut(worldName string, overseer string, magicRunes string, config ServerConfig) (LockToken, error) {
+	tok, exists := getStatus(worldName)
+	if !exists {
+		return tok, errors.New(fmt.Sprintf("No world named '%s'", worldName))
+	}
+	if tok.Status != STATUS_CHECKOUT || tok.MagicRunes != magicRunes {
+		return tok, errors.New(fmt.Sprintf("Overseer %s is not the currect holder of world %s", overseer, worldName))
+	}
+	statusLock.Lock()
+	queue := queueMap[worldName]
+	statusLock.Unlock()
+	if len(queue.Overseers) > 0 {
+		return tok, errors.New(fmt.Sprintf("Cannot extend check-out of world %s because overseer %s is waiting for their turn", worldName, queue.Overseers[0]))
+	}
+	wconf, err := loadWorldConfig(worldName, config)
+	if err != nil {
+		return tok, err
+	}
+	extension, _ := time.ParseDuration(wconf.ExtensionTime)
+	maxTime, _ := time.ParseDuration(wconf.MaxCheckOutTime)
+	expires, err := time.Parse(time.RFC3339, tok.Expires)
+	if err != nil {
+		return tok, err
+	}
+	checkedOut, err := time.Parse(time.RFC3339, tok.CheckedOut)
+	if err != nil {
+		// token from before check-out times were recorded
+		checkOutTime, _ := time.ParseDuration(wconf.CheckOutTimeLimit)
+		checkedOut = expires.Add(-checkOutTime)
+	}
+	if time.Now().After(expires) {
+		// in the grace period, so start from now
+		expires = time.Now()
+	}
+	newExpires := expires.Add(extension)
+	limit := checkedOut.Add(maxTime)
+	if newExpires.After(limit) {
+		newExpires = limit
+	}
+	if !newExpires.After(expires) {
+		return tok, errors.New(fmt.Sprintf("World %s has already been checked-out for the maximum time of %s", worldName, wconf.MaxCheckOutTime))
+	}
+	newToken := tok
+	newToken.Expires = newExpires.Format(time.RFC3339)
+	oldToken, err := setStatus(worldName, newToken, config)
+	if err != nil {
+		return tok, err
+	}
+	if oldToken.MagicRunes != magicRunes {
+		// Thread race accident, the world was checked-in in the meantime
+		setStatus(worldName, oldToken, config)
+		return tok, errors.New(fmt.Sprintf("Overseer %s is not the currect holder of world %s", overseer, worldName))
+	}
+	err = writeHistoryLine(time.Now(), worldName, overseer, fmt.Sprintf("Check-out extended until %s", newToken.Expires), config)
+	return newToken, err
+}
+
+// returns the overseer that a world is reserved for (and until when), or "" if it is not reserved
+func reservation(worldName string) (string, string) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	queue := queueMap[worldName]
+	if len(queue.Overseers) == 0 || queue.ReservedUntil == "" {
+		return "", ""
+	}
+	return queue.Overseers[0], queue.ReservedUntil
+}
+
+func joinQueue(worldName string, overseer string, config ServerConfig) error {
+	tok, exists := getStatus(worldName)
+	if !exists {
+		return errors.New(fmt.Sprintf("No world named '%s'", worldName))
+	}
+	if tok.Status == STATUS_INVALID {
+		return errors.New(fmt.Sprintf("World %s is invalid", worldName))
+	}
+	if tok.Status != STATUS_AVAILABLE && tok.CurrentOverseer == overseer {
+		return errors.New(fmt.Sprintf("Overseer %s already has world %s", overseer, worldName))
+	}
+	wconf, err := loadWorldConfig(worldName, config)
+	if err != nil {
+		return err
+	}
+	if !wconf.allowsOverseer(overseer) {
+		return errors.New(fmt.Sprintf("Overseer %s is not allowed to check-out world '%s'", overseer, worldName))
+	}
+	statusLock.Lock()
+	queue := queueMap[worldName]
+	for _, o := range queue.Overseers {
+		if o == overseer {
+			statusLock.Unlock()
+			return errors.New(fmt.Sprintf("Overseer %s is already waiting for world %s", overseer, worldName))
+		}
+	}
+	// (a copy, so that the stored queue is only changed by storeQueue)
+	queue.Overseers = append(append([]string{}, queue.Overseers...), overseer)
+	err = storeQueue(worldName, queue, config)
+	statusLock.Unlock()
+	if err != nil {
+		return err
+	}
+	warn(writeHistoryLine(time.Now(), worldName, overseer, fmt.Sprintf("Overseer %s is waiting for a turn", overseer), config))
+	if tok.Status == STATUS_AVAILABLE {
+		return startReservation(worldName, time.Now(), config)
+	}
+	return nil
+}
+
+func leaveQueue(worldName string, overseer string, config ServerConfig) error {
+	statusLock.Lock()
+	queue := queueMap[worldName]
+	remaining := filterStrings(queue.Overseers, func(o string) bool { return o != overseer })
+	if len(remaining) == len(queue.Overseers) {
+		statusLock.Unlock()
+		return nil
+	}
+	if len(queue.Overseers) > 0 && queue.Overseers[0] == overseer {
+		// the next overseer gets a fresh reservation (if the world is available)
+		queue.ReservedUntil = ""
+	}
+	queue.Overseers = remaining
+	err := storeQueue(worldName, queue, config)
+	statusLock.Unlock()
+	if err != nil {
+		return err
+	}
+	tok, _ := getStatus(worldName)
+	if tok.Status == STATUS_AVAILABLE {
+		return startReservation(worldName, time.Now(), config)
+	}
+	return nil
+}
+
+// reserves an available world for the first overseer in its queue, if it is not reserved already
+func startReservation(worldName string, tnow time.Time, config ServerConfig) error {
+	wconf, err := loadWorldConfig(worldName, config)
+	if err != nil {
+		return err
+	}
+	rd, _ := time.ParseDuration(wconf.ReservationTime)
+	statusLock.Lock()
+	queue := queueMap[worldName]
+	if len(queue.Overseers) == 0 || queue.ReservedUntil != "" {
+		statusLock.Unlock()
+		return nil
+	}
+	queue.ReservedUntil = tnow.Add(rd).Format(time.RFC3339)
+	err = storeQueue(worldName, queue, config)
+	statusLock.Unlock()
+	if err != nil {
+		return err
+	}
+	logEvent(&Event{Type: EVENT_TURN, World: worldName, Overseer: queue.Overseers[0]}, config)
+	return writeHistoryLine(tnow, worldName, queue.Overseers[0], fmt.Sprintf("It is now the turn of overseer %s", queue.Overseers[0]), config)
+}
+
+// moves on to the next overseer in the queue if the current one did not check-out the world in time
+func advanceQueue(worldName string, tnow time.Time, config ServerConfig) {
+	holder, until := reservation(worldName)
+	if holder == "" {
+		warn(startReservation(worldName, tnow, config))
+		return
+	}
+	reservedUntil, err := time.Parse(time.RFC3339, until)
+	if err == nil && !tnow.After(reservedUntil) {
+		return
+	}
+	logger.Infof("Overseer %s missed their turn for world %s", holder, worldName)
+	warn(writeHistoryLine(tnow, worldName, holder, fmt.Sprintf("Overseer %s missed their turn", holder), config))
+	logEvent(&Event{Type: EVENT_MISSED_TURN, World: worldName, Overseer: holder}, config)
+	warn(leaveQueue(worldName, holder, config))
+}
+
+// stores and saves the queue of a world (the caller must hold statusLock)
+func storeQueue(worldName string, queue TurnQueue, config ServerConfig) error {
+	queueFile := filepath.Join(config.WorldSaveFolder, fmt.Sprintf("%s.dfq", worldName))
+	if len(queue.Overseers) == 0 {
+		delete(queueMap, worldName)
+		if fileExists(queueFile) {
+			return os.Remove(queueFile)
+		}
+		return nil
+	}
+	queueMap[worldName] = queue
+	jstr, _ := json.MarshalIndent(queue, "", "\t")
+	return ioutil.WriteFile(queueFile, jstr, 0664)
+}
+
 func newMagicRunes() string {
 	n := 10
 	bb := make([]byte, n, n)
@@ -579,11 +1720,17 @@ func writeHistoryLine(t time.Time, world string, overseer string, event string,
 }
 
 func copySave(srcZip string, destZip string, config ServerConfig) error {
-	fmt.Printf("Extracting save files from %s to %s...\n", srcZip, destZip)
+	logger.Infof("Extracting save files from %s to %s...", srcZip, destZip)
 	var token LockToken
+	// the world's SaveFiles patterns decide which files are kept
+	wconf, err := loadWorldConfig(nameFromFile(destZip), config)
+	if err != nil {
+		return err
+	}
+	token.SaveFiles = wconf.SaveFiles
 	tmpDir := filepath.Join(config.TempFolder, nameFromFile(destZip))
 	defer deleteDir(tmpDir)
-	err := os.MkdirAll(tmpDir, 0775)
+	err = os.MkdirAll(tmpDir, 0775)
 	if err != nil {
 		return err
 	}
@@ -606,6 +1753,16 @@ func copySave(srcZip string, destZip string, config ServerConfig) error {
 	return nil
 }
 
+// the folder in the save folder with the server's own files (check-ins, overseers, webhook queue)
+func stateDir(config ServerConfig) string {
+	return filepath.Join(config.WorldSaveFolder, STATE_FOLDER)
+}
+
+// the path of one of the server's own files
+func stateFile(name string, config ServerConfig) string {
+	return filepath.Join(stateDir(config), name)
+}
+
 // returns true if it made a new dir
 func ensureDir(dirPath string) (bool, error) {
 	if !fileExists(dirPath) {
@@ -616,15 +1773,11 @@ func ensureDir(dirPath string) (bool, error) {
 
 func fail(e error) {
 	if e != nil {
-		log.Print(e)
-		fmt.Printf("ERROR: %v\n", e)
-		fmt.Printf("Program terminated due to error.\n")
+		logger.Errorf("%v", e)
+		logger.Errorf("Program terminated due to error.")
 		os.Exit(1)
 	}
 }
 func warn(e error) {
-	if e != nil {
-		log.Print(e)
-		fmt.Printf("WARNING: %v\n", e)
-	}
+	logger.Warn(e)
 }
@@ -1,467 +1,1047 @@
-package main
-
-import (
-	"bufio"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"log"
-	"net"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"strconv"
-	"strings"
-
-	"github.com/pkg/errors"
-
-	"github.com/gen2brain/dlgs"
-	"github.com/sqweek/dialog"
-)
-
-type ClientConfig struct {
-	OverseerName     string
-	CloudFortVersion string
-	HostName         string
-	PortNumber       int64
-}
-
-func main() {
-	fmt.Println("Starting ClodFort client...")
-	fmt.Println("DO NOT CLOSE THIS WINDOW!!!")
-	fmt.Println("Closing this window will NOT corrupt any data nor cause any harm, but closing this window will forcibly terminate the program, interrupting any file transfers.")
-	// first, initialize and setup the environment
-	thisFile, err := os.Executable()
-	errCheck(err)
-	thisDir := filepath.Dir(thisFile)
-	err = os.Chdir(thisDir)
-	errCheck(err)
-	var dfPath string // "df" or "dfhack" on linux and Mac, "Dwarf Fortress.exe" on windows
-	foundDF := false
-	for _, binName := range []string{"Dwarf Fortress.exe", "dfhack", "df"} {
-		bp := filepath.Join(thisDir, binName)
-		if fileExists(bp) {
-			dfPath = bp
-			foundDF = true
-			break
-		}
-	}
-	if !foundDF {
-		errCheck(errors.New("Dwarf Fortress executable not found!"))
-		os.Exit(1)
-	}
-	saveDir := filepath.Join(thisDir, "data", "save")
-	os.MkdirAll(saveDir, 0777) // safely does nothing if directory already exists
-
-	fmt.Printf("Starting CloudFort in %s...\n", thisDir)
-
-	defaultConfig := ClientConfig{
-		CloudFortVersion: CloudFortVersion,
-		HostName:         "localhost",
-		PortNumber:       13137,
-		OverseerName:     "",
-	}
-	var config ClientConfig
-	configFile := filepath.Join(thisDir, "CloudFort-config.json")
-	if !fileExists(configFile) {
-		fmt.Println("Config file does not exist. Creating a new one...")
-		fmt.Println("...asking overseer for their name...")
-		for {
-			name, ok, err := dlgs.Entry("Identify yourself!", "What is your name, overseer?", "")
-			errCheck(err)
-			name = strings.TrimSpace(name)
-			if ok && validateName(name) {
-				defaultConfig.OverseerName = name
-				break
-			} else {
-				errorPopup("That name is not acceptable! Try again.")
-			}
-		}
-		fmt.Println("...asking overseer for server address...")
-		for {
-			hostStr, ok, err := dlgs.Entry("Cloud Address", "Enter the server address and port number, separated by a : colon. For example, localhost:13137 or 192.168.0.107:13137 or mycloud.net:8013", fmt.Sprintf("%s:%d", defaultConfig.HostName, defaultConfig.PortNumber))
-			errCheck(err)
-			sa := strings.SplitN(hostStr, ":", 2)
-			defaultConfig.HostName = sa[0]
-			defaultConfig.PortNumber, err = strconv.ParseInt(sa[1], 10, 0)
-			if err == nil && ok {
-				resp, err := textServer(defaultConfig.HostName, int(defaultConfig.PortNumber), COM_CONCHECK)
-				if err == nil && strings.TrimSpace(resp) == RESP_CONCHECK {
-					// connection good
-					break
-				} else {
-					errorPopup(fmt.Sprintf("Unable to contact server. \n\n%v", err))
-					if !askUser("Edit server address and try again?", "Try again?") {
-						os.Exit(0)
-					}
-				}
-			} else {
-				errorPopup("That address is not acceptable! Try again.")
-			}
-		}
-		fmt.Println("...creating config file...")
-		jstr, _ := json.MarshalIndent(defaultConfig, "", "\t")
-		err := ioutil.WriteFile(configFile, jstr, 0664)
-		errCheck(err)
-		config = defaultConfig
-		infoPopup("Success!", fmt.Sprintf("Success! You can change your overseer name and server address by editing the file %s", configFile))
-	} else {
-		jstr, err := ioutil.ReadFile(configFile)
-		errCheck(err)
-		config = defaultConfig
-		err = json.Unmarshal(jstr, &config)
-		errCheck(err)
-		infoPopup(fmt.Sprintf("Welcome, %s!", config.OverseerName), fmt.Sprintf(
-			"Welcome, %s, to CloudFort! You can check-out worlds from CloudFort server %s:%d. Note that you can change your overseer name and server address by editing the file %s",
-			config.OverseerName, config.HostName, config.PortNumber, configFile))
-	}
-	err = sanityCheck(config)
-	errCheck(err)
-
-	fmt.Printf("...checking save folders for left-over check-outs...\n")
-	err = checkWorldDirs(saveDir, config)
-	errCheck(err)
-
-	fmt.Printf("...connecting to server...\n")
-	hostName := config.HostName
-	portNum := int(config.PortNumber)
-	fmt.Printf("\tHost: %s\n\tPort: %d\n", hostName, portNum)
-	msg, err := textServer(hostName, portNum, COM_STATUS)
-	errCheck(err)
-	fmt.Println(msg)
-	var worlds map[string]LockToken
-	err = json.Unmarshal([]byte(msg), &worlds)
-	errCheck(err)
-	worldLabels := make([]string, 0, 32)
-	label2WorldMap := make(map[string]string)
-	for k, v := range worlds {
-		fmt.Printf("%s: %s\n", k, v.Status)
-		wl := fmt.Sprintf("%s: %s", k, v.Status)
-		worldLabels = append(worldLabels, wl)
-		label2WorldMap[wl] = k
-	}
-	item, _, err := dlgs.List("CloudFort World Selection", "Select a world:", worldLabels)
-	errCheck(err)
-	if item == "" {
-		fmt.Println("No world selected.")
-	} else {
-		worldSelect := label2WorldMap[item]
-		fmt.Printf("Selected %s", worldSelect)
-		err := checkOut(worldSelect, saveDir, config)
-		errCheck(err)
-	}
-
-	//os.Exit(0)
-
-	fmt.Println("Starting Dwarf Fortress...")
-
-	dfCmd := exec.Command(dfPath)
-	_ = dfCmd.Run() // blocks until subprocess terminates
-	//errCheck(errors.Wrapf(err, "Dwarf Fortress executable '%s' failed to run or terminated with error status", dfPath))
-	// DF returns error code even on normal exit
-
-	fmt.Println("...DF closed. Checking-in CloudFort worlds,please do not close this window...")
-	err = checkWorldDirs(saveDir, config)
-	errCheck(err)
-
-	fmt.Println("...Complete! Terminating CloudFort...")
-
-	fmt.Println("...Done!")
-
-	os.Exit(0)
-
-}
-
-func checkWorldDirs(saveDir string, config ClientConfig) error {
-	saveWorldDirs, err := listDirs(saveDir)
-	if err != nil {
-		return err
-	}
-	for _, worldDirPath := range saveWorldDirs {
-		tokenPath := filepath.Join(worldDirPath, "token.dftk")
-		if fileExists(tokenPath) {
-			jstr, err := ioutil.ReadFile(tokenPath)
-			var checkoutToken LockToken
-			err = json.Unmarshal(jstr, &checkoutToken)
-			errCheck(err)
-			worldName := filepath.Base(worldDirPath)
-			yesCheckIn := askUser(
-				fmt.Sprintf("World '%s' has been checked-out from the server. Would you like to check-in this world?", worldName), "Check-in world?")
-			yesRevert := false
-			if !yesCheckIn {
-				yesRevert = askUser(
-					fmt.Sprintf("Do you want to revert world '%s' to it's previous state, losing any changes to since check-out?", worldName), "Revert world?")
-			}
-			if yesCheckIn {
-				fmt.Printf("User requested to check-in %s\n", worldName)
-				err := checkIn(worldDirPath, checkoutToken, config)
-				errCheck(err)
-			} else if yesRevert {
-				fmt.Printf("User requested to revert %s\n", worldName)
-				err := cancelCheckOut(worldName, config.OverseerName, checkoutToken.MagicRunes, config)
-				errCheck(err)
-			}
-		}
-	}
-	return nil
-}
-
-func checkIn(worldDir string, token LockToken, config ClientConfig) error {
-	world := filepath.Base(worldDir)
-	fmt.Printf("Checking in world %s\n", world)
-	// first, zip the save to a temp file
-	tmpFile, err := os.CreateTemp("", "CloudFort-upload.*.temp")
-	if err != nil {
-		return err
-	}
-	err = tmpFile.Close()
-	defer os.Remove(tmpFile.Name())
-	zipPath := tmpFile.Name()
-	if err != nil {
-		return err
-	}
-	fmt.Printf("Zipping region folder to %s...\n", zipPath)
-	saveFiles, err := scanDir(worldDir)
-	if err != nil {
-		return err
-	}
-	saveFiles = filterStrings(saveFiles, saveFileFilter)
-	err = zipFiles(worldDir, saveFiles, zipPath)
-	if err != nil {
-		return err
-	}
-	fmt.Printf("Hashing file %s...\n", zipPath)
-	hash, err := hashFile(zipPath)
-	if err != nil {
-		return err
-	}
-	fstat, err := os.Stat(zipPath)
-	if err != nil {
-		return err
-	}
-	// next, connect to the server
-	hostStr := fmt.Sprintf("%s:%d", config.HostName, config.PortNumber)
-	fmt.Printf("Contacting server %s\n", hostStr)
-	connection, err := net.Dial("tcp", hostStr)
-	if err != nil {
-		return errors.New(fmt.Sprintf("errChecked to connect to server %s \n\t%v", hostStr, err))
-	}
-	defer connection.Close()
-	// send check-in request
-	fmt.Printf("Requesting checkin\n")
-	serverReader := bufio.NewReader(connection)
-	_, err = connection.Write(strToUtf8(fmt.Sprintf("%s:%s:%s:%s\n", COM_CHECKIN, config.OverseerName, world, token.MagicRunes)))
-	if err != nil {
-		return err
-	}
-	resp, err := serverReader.ReadString('\n')
-	fmt.Printf("Received %s\n", resp)
-	if err != nil {
-		return err
-	}
-	if strings.TrimSpace(resp) == RESP_UPLOAD {
-		// server gave the go-ahead, proceed
-		fmt.Printf("Sending hash %s\n", hash)
-		_, err = connection.Write(strToUtf8(fmt.Sprintf("%s\n", hash)))
-		if err != nil {
-			return err
-		}
-		// now transmit the file
-		fmt.Printf("Sending file data\n")
-		tf, err := os.Open(zipPath)
-		if err != nil {
-			return err
-		}
-		//buf := make([]byte, 0x100000)
-		//_, err = io.CopyBuffer(connection, tf, buf)
-		err = sendFile(tf, connection, fstat.Size(), true)
-		if err != nil {
-			return err
-		}
-		// did it succeed?
-		resp, err := serverReader.ReadString('\n')
-		fmt.Printf("Server response: %s\n", resp)
-		if strings.TrimSpace(resp) != RESP_SUCCESS {
-			err = errors.New(resp)
-			return err
-		}
-		deleteDir(worldDir)
-		fmt.Printf("Check-in complete\n")
-	} else {
-		e := errors.New(resp)
-		return e
-	}
-	return nil
-}
-
-func checkOut(world string, saveDir string, config ClientConfig) error {
-	// check for name collision
-	dirPath := filepath.Join(saveDir, world)
-	if fileExists(dirPath) {
-		// save folder already exists!
-		return errors.New(fmt.Sprintf("Cannot checkout save for world %s because save folder %s already exists", world, dirPath))
-	}
-	// first, request checkout from server and see if it is available
-	hostStr := fmt.Sprintf("%s:%d", config.HostName, config.PortNumber)
-	fmt.Printf("Contacting server %s\n", hostStr)
-	connection, err := net.Dial("tcp", hostStr)
-	if err != nil {
-		return errors.New(fmt.Sprintf("errChecked to connect to server %s \n\t%v", hostStr, err))
-	}
-	defer connection.Close()
-	//
-	fmt.Printf("Requesting checkout\n")
-	serverReader := bufio.NewReader(connection)
-	_, err = connection.Write(strToUtf8(fmt.Sprintf("%s:%s:%s\n", COM_CHECKOUT, config.OverseerName, world)))
-	if err != nil {
-		return err
-	}
-	resp, err := serverReader.ReadString('\n')
-	fmt.Printf("Received %s\n", resp)
-	if err != nil {
-		return err
-	}
-	if strings.HasPrefix(resp, RESP_ERROR) {
-		e := errors.New(resp)
-		return e
-	} else if strings.TrimSpace(resp) == RESP_DOWNLOAD {
-		// yes it is available, proceed to download
-		// first, read the lock token for the magic rune sequence
-		jstr, err := serverReader.ReadString('\n')
-		fmt.Printf("Received %s\n", jstr)
-		if err != nil {
-			return err
-		}
-		var checkoutToken LockToken
-		err = json.Unmarshal([]byte(jstr), &checkoutToken)
-		if err != nil {
-			return err
-		}
-		dbgjstr, _ := json.MarshalIndent(checkoutToken, "", " ")
-		fmt.Printf("checkout token:\n%s\n", string(dbgjstr))
-		// read the file hash
-		hash_, err := serverReader.ReadString('\n')
-		hash := strings.TrimSpace(hash_)
-		// then download zip file from server to a temp file
-		//tmpDir := os.TempDir()
-		outFile, err := os.CreateTemp("", "CloudFort-download.*.temp")
-		if err != nil {
-			return err
-		}
-		fmt.Printf("Downloading to temp file %s\n", outFile.Name())
-		defer os.Remove(outFile.Name())
-		//buf := make([]byte, 0x100000)
-		//_, err = io.CopyBuffer(outFile, serverReader, buf)
-		err = recvFile(serverReader, outFile, true)
-		if err != nil {
-			return err
-		}
-		err = outFile.Close()
-		if err != nil {
-			return err
-		}
-		fmt.Printf("Data transferred!\n")
-		undoFunc := func(e error) {
-			fmt.Printf("Check-out failed, checking back in...\n")
-			err2 := cancelCheckOut(world, config.OverseerName, checkoutToken.MagicRunes, config)
-			if err2 != nil {
-				errCheck(errors.New(fmt.Sprintf("Double error: %v; %v", e, err2)))
-			}
-		}
-		// now check the hashes to guard against incomplete (or tampered) data transfer
-		fhash, err := hashFile(outFile.Name())
-		errCheck(err)
-		fmt.Printf("Hash check:\n    server hash: %s\n  download hash: %s\n", hash, fhash)
-		if hash != fhash {
-			fmt.Println("FAILURE: file hash mismatch!")
-			// uh-oh, files don't match
-			defer undoFunc(err)
-		}
-		// finally, extract only relevant files from download to save folder
-		fmt.Printf("Extracting files from %s to %s\n", outFile.Name(), dirPath)
-		err = extractSave(outFile.Name(), dirPath, checkoutToken)
-		if err != nil {
-			defer undoFunc(err)
-			return err
-		}
-		fmt.Printf("...Done!\n")
-	}
-	return nil
-}
-
-func cancelCheckOut(world string, overseer string, worldMagicRunes string, config ClientConfig) error {
-	// tell server to make this world available again without checking it back in
-	resp, err := textServer(config.HostName, int(config.PortNumber), fmt.Sprintf("%s:%s:%s:%s", COM_RELEASE, overseer, world, worldMagicRunes))
-	if err != nil {
-		return err
-	}
-	if strings.HasPrefix(resp, RESP_ERROR) {
-		e := errors.New(resp)
-		return e
-	}
-	return nil
-}
-
-func sanityCheck(config ClientConfig) error {
-	if strings.ContainsRune(config.OverseerName, ':') {
-		return errors.New("Invalid overseer name: name must not contain ':'")
-	}
-	return nil
-}
-
-func errCheck(e error) {
-	if e != nil {
-		log.Print(e)
-		errorPopup(fmt.Sprintf("%v", e))
-		os.Exit(1)
-	}
-}
-func errorPopup(msg string) {
-	dialog.Message("%s", msg).Title("Error!").Error()
-}
-func infoPopup(title, msg string) {
-	dialog.Message("%s", msg).Title(title).Info()
-}
-func askUser(question string, title string) bool {
-	yes := dialog.Message("%s", question).Title(title).YesNo()
-	return yes
-}
-
-func textServer(hostName string, portNum int, msg string) (string, error) {
-	hostStr := fmt.Sprintf("%s:%d", hostName, portNum)
-	connection, err := net.Dial("tcp", hostStr)
-	if err != nil {
-		return "", errors.New(fmt.Sprintf("Failed to connect to server %s \n\t%v", hostStr, err))
-	}
-	defer connection.Close()
-	//
-	serverReader := bufio.NewReader(connection)
-	_, err = connection.Write(strToUtf8(fmt.Sprintf("%s\n", msg)))
-	fmt.Printf("sent %v", msg)
-	if err != nil {
-		errMsg := fmt.Sprintf("I/O error: errChecked to send message to server \n\t%v", err)
-		return "", errors.New(errMsg)
-	}
-	serverResponse, err := serverReader.ReadString('\n')
-	fmt.Printf("received %v", serverResponse)
-	return serverResponse, nil
-}
-func saveFileFilter(s string) bool {
-	for _, regex := range saveRegexes {
-		if regex.MatchString(s) {
-			return true
-		}
-	}
-	return false
-}
-func validateName(name string) bool {
-	if len(name) == 0 {
-		return false
-	}
-	for _, r := range []rune{':', ';', '/', '\\', '\n', '\t', '%'} {
-		if strings.ContainsRune(name, r) {
-			return false
-		}
-	}
-	return true
-}
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gen2brain/dlgs"
+	"github.com/sqweek/dialog"
+)
+
+type ClientConfig struct {
+	OverseerName     string // the overseer name, host name and port number of the server in use, copied from its profile
+	CloudFortVersion string
+	HostName         string
+	PortNumber       int64
+	Profiles         []ServerProfile // the servers this client can use (see CloudFort-Profiles.go)
+	Profile          string          // name of the profile in use
+	server           ServerProfile
+	local            DFInstall // set when CloudFort starts
+	Logging          LogConfig
+	Launcher         DFLauncher
+	AgentPortNumber  int64    // port of the agent's local API (see CloudFort-Agent.go)
+	PollInterval     string   // how often the agent asks the server for the status of the worlds
+	WatchWorlds      []string // worlds the agent announces when they become available
+	BackupsKept      int      // number of check-ins and of check-outs of each world kept in data/cloudfort-backups (0 for none)
+	AutoCheckpoint   string   // how often to checkpoint the checked-out worlds while DF runs, "" for never
+	SaveSettleTime   string   // how long the save files of a world must be unchanged before they are zipped
+}
+
+// what is known about the local Dwarf Fortress installation
+type DFInstall struct {
+	Dir        string // the Dwarf Fortress folder
+	Executable string // what the launcher runs ("" if CloudFort does not start DF)
+	Version    string // "" if unknown
+	SaveFormat uint32 // save format of the newest local save, 0 if unknown
+	Layout     *SaveLayout
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(agentCtl(os.Args[2:]))
+	}
+	agentMode := len(os.Args) > 1 && os.Args[1] == "agent"
+	checkpointMode := len(os.Args) > 1 && os.Args[1] == "checkpoint"
+	fmt.Println("Starting ClodFort client...")
+	fmt.Println("DO NOT CLOSE THIS WINDOW!!!")
+	fmt.Println("Closing this window will NOT corrupt any data nor cause any harm, but closing this window will forcibly terminate the program, interrupting any file transfers.")
+	// first, initialize and setup the environment
+	thisFile, err := os.Executable()
+	errCheck(err)
+	thisDir := filepath.Dir(thisFile)
+	err = os.Chdir(thisDir)
+	errCheck(err)
+	configFile := filepath.Join(thisDir, "CloudFort-config.json")
+	dfDir := dfFolder(thisDir, configFile)
+	saveDir := findSaveFolder(dfDir, detectSaveLayout(dfDir, detectDFVersion(dfDir)))
+	if fileExists(dfDir) {
+		// (a wrong DFDir is reported by findLocalDF, instead of making folders there)
+		os.MkdirAll(saveDir, 0777) // safely does nothing if directory already exists
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		err = restoreCommand(saveDir, os.Args[2:])
+		errCheck(err)
+		os.Exit(0)
+	}
+	logger.Infof("Starting CloudFort in %s...", thisDir)
+
+	var config ClientConfig
+	if !fileExists(configFile) {
+		logger.Infof("Config file does not exist. Creating a new one...")
+		config = defaultClientConfig()
+		p := askForProfile("default", config)
+		config.Profiles = []ServerProfile{p}
+		config, err = config.forServer(p.Name)
+		errCheck(err)
+		logger.Infof("...creating config file...")
+		err = saveClientConfig(configFile, config)
+		errCheck(err)
+		infoPopup("Success!", fmt.Sprintf("Success! You can change your overseer name and server address by editing the \"%s\" entry in the Profiles of the file %s, or add another server by running \"CloudFort add-server\"", p.Name, configFile))
+	} else {
+		config, err = loadClientConfig(configFile)
+		errCheck(err)
+		if len(os.Args) > 1 && os.Args[1] == "add-server" {
+			config, err = addProfile(configFile, config)
+			errCheck(err)
+		} else if !agentMode && !checkpointMode && len(config.Profiles) > 1 {
+			config, err = pickProfile(configFile, config)
+			errCheck(err)
+		}
+		if !agentMode && !checkpointMode {
+			infoPopup(fmt.Sprintf("Welcome, %s!", config.OverseerName), fmt.Sprintf(
+				"Welcome, %s, to CloudFort! You can check-out worlds from CloudFort server %s:%d. Note that you can change your overseer name and server address by editing the \"%s\" entry in the Profiles of the file %s, or add another server by running \"CloudFort add-server\"",
+				config.OverseerName, config.HostName, config.PortNumber, config.Profile, configFile))
+		}
+	}
+	err = sanityCheck(config)
+	errCheck(err)
+	err = setupLogging(config.Logging)
+	errCheck(err)
+	localDF, err := findLocalDF(dfDir, saveDir, config.Launcher)
+	errCheck(err)
+	logger.Infof("Found Dwarf Fortress %s (save format %d, %s save layout) at %s, saves in %s", localDF.Version, localDF.SaveFormat, localDF.Layout.Name, localDF.Executable, saveDir)
+	config.local = localDF
+
+	if agentMode {
+		err = runAgent(saveDir, localDF, configFile, config)
+		errCheck(err)
+		os.Exit(0)
+	}
+	if checkpointMode {
+		err = checkpointCommand(saveDir, os.Args[2:], config)
+		errCheck(err)
+		os.Exit(0)
+	}
+	agentRunning := agentIsRunning(config)
+	if agentRunning {
+		// the agent offers to check-in when the DF it started closes, so it must not be done here
+		logger.Infof("...the CloudFort agent is running and will take care of check-ins...")
+	} else {
+		logger.Infof("...checking save folders for left-over check-outs...")
+		err = checkWorldDirs(saveDir, config)
+		errCheck(err)
+	}
+
+	logger.Infof("...connecting to server...")
+	hostName := config.HostName
+	portNum := int(config.PortNumber)
+	logger.Infof("Host: %s, port: %d", hostName, portNum)
+	msg, err := textServer(config.server, COM_STATUS)
+	if err != nil {
+		// without the server, the worlds that are already checked-out can still be played
+		local := checkedOutWorlds(saveDir)
+		if len(local) == 0 {
+			errCheck(err)
+		}
+		logger.Warnf("Failed to contact server: %v", err)
+		infoPopup("Playing offline", fmt.Sprintf(
+			"CloudFort can't reach server %s:%d right now (%v). You can keep playing the worlds you have checked-out (%s), and CloudFort will check them in when the server can be reached again.",
+			hostName, portNum, err, strings.Join(local, ", ")))
+	} else {
+		logger.Debugf("Server status: %s", msg)
+		var worlds map[string]WorldStatus
+		err = json.Unmarshal([]byte(msg), &worlds)
+		errCheck(err)
+		worldLabels := make([]string, 0, 32)
+		label2WorldMap := make(map[string]string)
+		for k, v := range worlds {
+			logger.Debugf("%s: %s", k, v.Status)
+			wl := fmt.Sprintf("%s: %s", k, v.Status)
+			if v.Description != "" {
+				wl = fmt.Sprintf("%s - %s", wl, v.Description)
+			}
+			if len(v.Mods) > 0 {
+				wl = fmt.Sprintf("%s [mods: %s]", wl, strings.Join(v.Mods, ", "))
+			}
+			if v.ReservedFor != "" {
+				wl = fmt.Sprintf("%s, reserved for %s", wl, v.ReservedFor)
+			}
+			if len(v.Queue) > 0 {
+				wl = fmt.Sprintf("%s, %d waiting", wl, len(v.Queue))
+			}
+			if v.Problem != "" {
+				wl = fmt.Sprintf("%s (%s)", wl, v.Problem)
+			} else if v.Info != nil {
+				wl = fmt.Sprintf("%s (%s)", wl, v.Info.String())
+			}
+			worldLabels = append(worldLabels, wl)
+			label2WorldMap[wl] = k
+		}
+		item, _, err := dlgs.List("CloudFort World Selection", "Select a world:", worldLabels)
+		errCheck(err)
+		if item == "" {
+			logger.Infof("No world selected.")
+		} else {
+			worldSelect := label2WorldMap[item]
+			logger.Infof("Selected %s", worldSelect)
+			ws := worlds[worldSelect]
+			if ws.Status != STATUS_AVAILABLE || (ws.ReservedFor != "" && ws.ReservedFor != config.OverseerName) {
+				if ws.Status == STATUS_INVALID {
+					// (an invalid world can't be checked-out, so there is no point in waiting for it)
+					errorPopup(fmt.Sprintf("World '%s' is invalid on the server, ask the server admin to fix it.", worldSelect))
+				} else if askUser(fmt.Sprintf("World '%s' is not available right now. Would you like to join the queue and wait for your turn?", worldSelect), "Reserve world?") {
+					resp, err := textServer(config.server, fmt.Sprintf("%s:%s:%s", COM_RESERVE, config.OverseerName, worldSelect))
+					errCheck(err)
+					if strings.HasPrefix(resp, RESP_ERROR) {
+						errorPopup(resp)
+					} else {
+						infoPopup("Reserved!", fmt.Sprintf("You are now in the queue for world '%s'.", worldSelect))
+					}
+				}
+				if !ws.Spectators || !askUser(fmt.Sprintf("Would you like to download a read-only copy of world '%s' to look at? Nothing you do in the copy will be checked-in.", worldSelect), "Spectate world?") {
+					os.Exit(0)
+				}
+				err := peek(worldSelect, saveDir, config)
+				errCheck(err)
+				infoPopup("Spectating", fmt.Sprintf("The read-only copy of world '%s' is in the save folder %s-spectator", worldSelect, worldSelect))
+			} else {
+				if ws.DFVersion != "" && localDF.Version != "" && !sameDFVersion(ws.DFVersion, localDF.Version) {
+					if !askUser(fmt.Sprintf("World '%s' is played with Dwarf Fortress %s, but you have Dwarf Fortress %s. Playing a world with the wrong version of Dwarf Fortress can corrupt it. Check-out anyway?", worldSelect, ws.DFVersion, localDF.Version), "Wrong Dwarf Fortress version") {
+						os.Exit(0)
+					}
+				}
+				err := checkOut(worldSelect, saveDir, localDF, config)
+				errCheck(err)
+			}
+		}
+	}
+
+	//os.Exit(0)
+
+	if config.Launcher.NoLaunch {
+		logger.Infof("...not starting Dwarf Fortress (Launcher NoLaunch is set). Done!")
+		infoPopup("Start Dwarf Fortress", "CloudFort is set not to start Dwarf Fortress, so start it yourself. When you have finished playing, quit Dwarf Fortress and start CloudFort again to check-in your worlds.")
+		os.Exit(0)
+	}
+	if agentRunning {
+		_, err = agentRequest(config, "play", "")
+		errCheck(err)
+		logger.Infof("...Dwarf Fortress was started by the CloudFort agent, which will offer to check-in when it closes. Done!")
+		os.Exit(0)
+	}
+
+	logger.Infof("Starting Dwarf Fortress...")
+
+	dfCmd := dfCommand(localDF, config.Launcher)
+	watchDone := make(chan bool)
+	go watchExpirations(saveDir, config, watchDone)
+	checkpointDone := make(chan bool)
+	go autoCheckpoint(saveDir, config, checkpointDone)
+	_ = dfCmd.Run() // blocks until subprocess terminates
+	watchDone <- true
+	checkpointDone <- true
+	//errCheck(errors.Wrapf(err, "Dwarf Fortress executable '%s' failed to run or terminated with error status", localDF.Executable))
+	// DF returns error code even on normal exit
+
+	logger.Infof("...DF closed. Checking-in CloudFort worlds,please do not close this window...")
+	err = checkWorldDirs(saveDir, config)
+	errCheck(err)
+	if ops, err := loadJournal(saveDir); err == nil && len(ops) > 0 {
+		logger.Infof("...waiting for the server to finish the queued check-ins (if you close this window, they are tried again next time CloudFort starts)...")
+		retryQueuedCheckIns(saveDir, config, nil)
+	}
+
+	logger.Infof("...Complete! Terminating CloudFort...")
+
+	logger.Infof("...Done!")
+
+	os.Exit(0)
+
+}
+
+// the names of the worlds in the save folder that are checked-out (and not read-only copies)
+func checkedOutWorlds(saveDir string) []string {
+	var worlds []string
+	worldDirs, err := listDirs(saveDir)
+	if err != nil {
+		return worlds
+	}
+	for _, worldDir := range worldDirs {
+		if fileExists(filepath.Join(worldDir, "token.dftk")) && !fileExists(filepath.Join(worldDir, "spectator.dftk")) {
+			worlds = append(worlds, filepath.Base(worldDir))
+		}
+	}
+	return worlds
+}
+
+func checkWorldDirs(saveDir string, config ClientConfig) error {
+	// nothing can be checked-in while DF runs (eg if it was started without CloudFort, or is still closing)
+	if len(checkedOutWorlds(saveDir)) > 0 && waitForDFToClose(config.local.Dir, DF_EXIT_WAIT) {
+		logger.Warnf("Dwarf Fortress is running, not checking-in any worlds")
+		infoPopup("Dwarf Fortress is running", "Dwarf Fortress is running, so your checked-out worlds can't be checked-in now (they might be in the middle of being saved). Quit Dwarf Fortress and start CloudFort again to check them in.")
+		return nil
+	}
+	// first, finish any check-ins that were interrupted last time
+	replayJournal(saveDir, config)
+	saveWorldDirs, err := listDirs(saveDir)
+	if err != nil {
+		return err
+	}
+	// check-ins still in the journal are waiting for their server to be reachable again
+	queued := make(map[string]bool)
+	ops, err := loadJournal(saveDir)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		queued[op.World] = true
+	}
+	serverStatus := make(map[string]map[string]WorldStatus) // server profile -> world status, asked once per server
+	for _, worldDirPath := range saveWorldDirs {
+		tokenPath := filepath.Join(worldDirPath, "token.dftk")
+		if fileExists(filepath.Join(worldDirPath, "spectator.dftk")) {
+			// read-only copies are never checked-in
+			logger.Infof("%s is a read-only copy, skipping", filepath.Base(worldDirPath))
+		} else if fileExists(tokenPath) {
+			jstr, err := ioutil.ReadFile(tokenPath)
+			var checkoutToken LockToken
+			err = json.Unmarshal(jstr, &checkoutToken)
+			errCheck(err)
+			worldName := filepath.Base(worldDirPath)
+			wconfig, err := config.forServer(checkoutToken.Server)
+			if err != nil {
+				logger.Warnf("Skipping world %s: %v", worldName, err)
+				errorPopup(fmt.Sprintf("World '%s' was checked-out from server '%s', which is no longer in CloudFort-config.json, so it cannot be checked-in.", worldName, checkoutToken.Server))
+				continue
+			}
+			if queued[worldName] {
+				logger.Infof("The check-in of world %s is queued until server '%s' can be reached", worldName, wconfig.Profile)
+				continue
+			}
+			worlds, asked := serverStatus[wconfig.Profile]
+			if !asked {
+				// (if the server can't be reached, the world is treated as still checked-out)
+				msg, err := textServer(wconfig.server, COM_STATUS)
+				if err == nil && json.Unmarshal([]byte(msg), &worlds) != nil {
+					worlds = nil
+				}
+				serverStatus[wconfig.Profile] = worlds
+			}
+			if gone := reconcileWorld(worldName, wconfig, worlds); gone != "" {
+				logger.Warnf("World %s is no longer checked-out to %s: %s", worldName, wconfig.OverseerName, gone)
+				if askUser(fmt.Sprintf("World '%s' is no longer checked-out to you (%s), so it cannot be checked-in. Do you want to keep your copy as a separate save? If not, it is left as it is and you will be asked again next time.", worldName, gone), "Keep local copy?") {
+					newDir, err := keepLocalCopy(worldDirPath)
+					errCheck(err)
+					logger.Infof("Kept world %s as %s", worldName, newDir)
+				}
+				continue
+			}
+			yesCheckIn := askUser(
+				fmt.Sprintf("World '%s' has been checked-out from the server. Would you like to check-in this world?", worldName), "Check-in world?")
+			yesRevert := false
+			if !yesCheckIn {
+				yesRevert = askUser(
+					fmt.Sprintf("Do you want to revert world '%s' to it's previous state, losing any changes to since check-out?", worldName), "Revert world?")
+			}
+			if yesCheckIn {
+				logger.Infof("User requested to check-in %s", worldName)
+				err := checkIn(worldDirPath, checkoutToken, wconfig)
+				if isOffline(err) {
+					logger.Warnf("Check-in of world %s failed: %v", worldName, err)
+					expires := checkoutToken.Expires
+					if t, err := time.Parse(time.RFC3339, expires); err == nil {
+						expires = t.Local().Format("Mon 15:04")
+					}
+					infoPopup("Check-in queued", fmt.Sprintf("Server '%s' can't be reached right now, so world '%s' will be checked-in as soon as it can be (before your check-out expires on %s).", wconfig.Profile, worldName, expires))
+					continue
+				}
+				errCheck(err)
+			} else if yesRevert {
+				logger.Infof("User requested to revert %s", worldName)
+				err := cancelCheckOut(worldName, wconfig.OverseerName, checkoutToken.MagicRunes, wconfig)
+				errCheck(err)
+			}
+		}
+	}
+	return nil
+}
+
+// uploads a world and deletes it from the save folder
+// the check-in is recorded in the journal until it is known whether the server got it, so that it can be safely retried
+func checkIn(worldDir string, token LockToken, config ClientConfig) error {
+	world := filepath.Base(worldDir)
+	saveDir := filepath.Dir(worldDir)
+	logger.Infof("Checking in world %s", world)
+	// a save must not be zipped while DF may be writing it
+	if dfIsRunning(config.local.Dir) {
+		return errors.New(fmt.Sprintf("Dwarf Fortress is still running, quit it before checking-in world %s", world))
+	}
+	err := waitForStableSave(worldDir, config)
+	if err != nil {
+		return err
+	}
+	// first, zip the save to a temp file
+	zipPath, hash, zipSize, err := zipSave(worldDir, config.local, token.SaveFiles)
+	if zipPath != "" {
+		defer os.Remove(zipPath)
+	}
+	if err != nil {
+		return err
+	}
+	op, err := beginOp(saveDir, OP_CHECKIN, world, token.Server)
+	if err != nil {
+		return err
+	}
+	// next, connect to the server
+	hostStr := fmt.Sprintf("%s:%d", config.HostName, config.PortNumber)
+	logger.Infof("Contacting server %s", hostStr)
+	connection, err := dialServer(config.server)
+	if err != nil {
+		return offlineError{errors.New(fmt.Sprintf("errChecked to connect to server %s \n\t%v", hostStr, err))}
+	}
+	defer connection.Close()
+	// send check-in request
+	logger.Infof("Requesting checkin")
+	serverReader := bufio.NewReader(connection)
+	_, err = connection.Write(strToUtf8(fmt.Sprintf("%s:%s:%s:%s:%s\n", COM_CHECKIN, config.OverseerName, world, token.MagicRunes, op.OpID)))
+	if err != nil {
+		return offlineError{err}
+	}
+	resp, err := serverReader.ReadString('\n')
+	logger.Debugf("Received %s", strings.TrimSpace(resp))
+	if err != nil {
+		return offlineError{err}
+	}
+	if strings.TrimSpace(resp) == RESP_SUCCESS {
+		// an earlier attempt of this check-in got through, so only the clean-up is left
+		logger.Infof("The server already has this check-in")
+		if err := backupSave(zipPath, saveDir, world, BACKUP_CHECKIN, token.SaveFiles, config); err != nil {
+			logger.Warnf("Failed to back up world %s: %v", world, err)
+		}
+		deleteDir(worldDir)
+		return endOp(saveDir, op.OpID)
+	} else if strings.TrimSpace(resp) == RESP_UPLOAD {
+		// server gave the go-ahead, proceed
+		logger.Debugf("Sending hash %s", hash)
+		_, err = connection.Write(strToUtf8(fmt.Sprintf("%s\n", hash)))
+		if err != nil {
+			return offlineError{err}
+		}
+		// now transmit the file
+		logger.Infof("Sending file data")
+		tf, err := os.Open(zipPath)
+		if err != nil {
+			return err
+		}
+		//buf := make([]byte, 0x100000)
+		//_, err = io.CopyBuffer(connection, tf, buf)
+		err = sendFile(tf, connection, zipSize, true)
+		tf.Close()
+		if err != nil {
+			return offlineError{err}
+		}
+		// did it succeed?
+		resp, err := serverReader.ReadString('\n')
+		logger.Infof("Server response: %s", resp)
+		if err != nil {
+			// the server may or may not have the check-in, so it stays in the journal to be retried
+			return offlineError{errors.Wrapf(err, "Lost the connection while checking in world %s", world)}
+		}
+		if strings.TrimSpace(resp) != RESP_SUCCESS {
+			dropOp(saveDir, op.OpID)
+			err = errors.New(resp)
+			return err
+		}
+		if err := backupSave(zipPath, saveDir, world, BACKUP_CHECKIN, token.SaveFiles, config); err != nil {
+			logger.Warnf("Failed to back up world %s: %v", world, err)
+		}
+		deleteDir(worldDir)
+		logger.Infof("Check-in complete")
+	} else {
+		// the server refused, so there is nothing to retry
+		dropOp(saveDir, op.OpID)
+		e := errors.New(resp)
+		return e
+	}
+	return endOp(saveDir, op.OpID)
+}
+
+// zips the save files of a world folder to a temp file, returning its path (for the caller to remove), hash and size
+// patterns are the world's SaveFiles patterns, from its token
+func zipSave(worldDir string, localDF DFInstall, patterns []string) (string, string, int64, error) {
+	tmpFile, err := os.CreateTemp("", "CloudFort-upload.*.temp")
+	if err != nil {
+		return "", "", 0, err
+	}
+	zipPath := tmpFile.Name()
+	err = tmpFile.Close()
+	if err != nil {
+		return zipPath, "", 0, err
+	}
+	logger.Infof("Zipping region folder to %s...", zipPath)
+	saveFiles, err := scanDir(worldDir)
+	if err != nil {
+		return zipPath, "", 0, err
+	}
+	saveFiles = localDF.saveFiles(worldDir, saveFiles, patterns)
+	err = zipFiles(worldDir, saveFiles, zipPath)
+	if err != nil {
+		return zipPath, "", 0, err
+	}
+	logger.Infof("Hashing file %s...", zipPath)
+	hash, err := hashFile(zipPath)
+	if err != nil {
+		return zipPath, "", 0, err
+	}
+	fstat, err := os.Stat(zipPath)
+	if err != nil {
+		return zipPath, "", 0, err
+	}
+	return zipPath, hash, fstat.Size(), nil
+}
+
+// an error reaching the server (as opposed to the server refusing a request), after which a check-in stays queued in the journal
+type offlineError struct {
+	err error
+}
+
+func (e offlineError) Error() string {
+	return e.err.Error()
+}
+
+func isOffline(err error) bool {
+	_, ok := err.(offlineError)
+	return ok
+}
+
+// checks-out a world into the save folder
+// the save is downloaded and extracted to a staging folder next to the save folder (on the same disk), and only moved into
+// the save folder once it is complete and valid, so a failed check-out never leaves a half-written save behind
+func checkOut(world string, saveDir string, localDF DFInstall, config ClientConfig) (err error) {
+	// check for name collision
+	dirPath := filepath.Join(saveDir, world)
+	if fileExists(dirPath) {
+		// save folder already exists!
+		return errors.New(fmt.Sprintf("Cannot checkout save for world %s because save folder %s already exists", world, dirPath))
+	}
+	stagingDir := filepath.Join(filepath.Dir(saveDir), "cloudfort-staging")
+	stagedPath := filepath.Join(stagingDir, world)
+	err = os.MkdirAll(stagingDir, 0777)
+	if err != nil {
+		return err
+	}
+	// (anything already there is left over from an interrupted check-out)
+	err = deleteDir(stagedPath)
+	if err != nil {
+		return err
+	}
+	defer deleteDir(stagedPath)
+	// first, request checkout from server and see if it is available
+	hostStr := fmt.Sprintf("%s:%d", config.HostName, config.PortNumber)
+	logger.Infof("Contacting server %s", hostStr)
+	connection, err := dialServer(config.server)
+	if err != nil {
+		return errors.New(fmt.Sprintf("errChecked to connect to server %s \n\t%v", hostStr, err))
+	}
+	defer connection.Close()
+	//
+	logger.Infof("Requesting checkout")
+	serverReader := bufio.NewReader(connection)
+	_, err = connection.Write(strToUtf8(fmt.Sprintf("%s:%s:%s:%s:%d\n", COM_CHECKOUT, config.OverseerName, world, localDF.Version, localDF.SaveFormat)))
+	if err != nil {
+		return err
+	}
+	resp, err := serverReader.ReadString('\n')
+	logger.Debugf("Received %s", strings.TrimSpace(resp))
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(resp, RESP_ERROR) {
+		return errors.New(resp)
+	} else if strings.TrimSpace(resp) != RESP_DOWNLOAD {
+		return errors.New(fmt.Sprintf("Unexpected response from server: %s", resp))
+	}
+	// yes it is available, proceed to download
+	// first, read the lock token for the magic rune sequence
+	jstr, err := serverReader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	var checkoutToken LockToken
+	err = json.Unmarshal([]byte(jstr), &checkoutToken)
+	if err != nil {
+		return err
+	}
+	// so that it is checked-in to the same server, whichever server profile is in use then
+	checkoutToken.Server = config.Profile
+	// from here on, the world is checked-out to this overseer, so give it back if anything goes wrong
+	defer func() {
+		if err != nil {
+			logger.Infof("Check-out failed, checking back in...")
+			err2 := cancelCheckOut(world, config.OverseerName, checkoutToken.MagicRunes, config)
+			if err2 != nil {
+				err = errors.New(fmt.Sprintf("Double error: %v; %v", err, err2))
+			}
+		}
+	}()
+	// read the file hash
+	hash_, err := serverReader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	hash := strings.TrimSpace(hash_)
+	// then download zip file from server to a temp file
+	outFile, err := os.CreateTemp(stagingDir, fmt.Sprintf("%s.*.zip", world))
+	if err != nil {
+		return err
+	}
+	logger.Infof("Downloading to temp file %s", outFile.Name())
+	defer os.Remove(outFile.Name())
+	err = recvFile(serverReader, outFile, true)
+	if err != nil {
+		outFile.Close()
+		return errors.Wrapf(err, "The download of world %s was interrupted", world)
+	}
+	err = outFile.Close()
+	if err != nil {
+		return err
+	}
+	// the server confirms once it has recorded the check-out
+	resp, err = serverReader.ReadString('\n')
+	if err != nil {
+		return errors.Wrap(err, "The server did not confirm the check-out")
+	}
+	if strings.TrimSpace(resp) != RESP_SUCCESS {
+		return errors.New(resp)
+	}
+	logger.Infof("Data transferred!")
+	// now check the hashes to guard against incomplete (or tampered) data transfer
+	fhash, err := hashFile(outFile.Name())
+	if err != nil {
+		return err
+	}
+	logger.Debugf("Hash check: server hash: %s, download hash: %s", hash, fhash)
+	if hash != fhash {
+		return errors.New(fmt.Sprintf("The download of world %s is corrupt (file hash mismatch)", world))
+	}
+	report, err := validateSaveZip(outFile.Name(), 0, checkoutToken.SaveFiles)
+	if err == nil && !report.IsValid() {
+		err = errors.New(strings.Join(report.Problems, "; "))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "The download of world %s is not a valid save", world)
+	}
+	// extract only relevant files from download to the staging folder
+	if err := backupSave(outFile.Name(), saveDir, world, BACKUP_CHECKOUT, checkoutToken.SaveFiles, config); err != nil {
+		logger.Warnf("Failed to back up world %s: %v", world, err)
+	}
+	logger.Infof("Extracting files from %s to %s", outFile.Name(), stagedPath)
+	err = extractSave(outFile.Name(), stagedPath, checkoutToken)
+	if err != nil {
+		return err
+	}
+	err = validateStagedSave(stagedPath, report, checkoutToken)
+	if err != nil {
+		return err
+	}
+	// finally, move the complete save into the save folder in one step
+	err = os.Rename(stagedPath, dirPath)
+	if err != nil {
+		return err
+	}
+	logger.Infof("...Done!")
+	return nil
+}
+
+// checks that an extracted save has every save file from the zip and the right token, before it is moved into the save folder
+func validateStagedSave(worldDir string, report SaveZipReport, token LockToken) error {
+	for _, f := range report.SaveFiles {
+		if !fileExists(filepath.Join(worldDir, f)) {
+			return errors.New(fmt.Sprintf("%s is missing from the extracted save", f))
+		}
+	}
+	stagedToken, err := readTokenFile(worldDir)
+	if err != nil {
+		return err
+	}
+	if stagedToken.MagicRunes != token.MagicRunes || stagedToken.Server != token.Server {
+		return errors.New("The check-out token was not written correctly")
+	}
+	return nil
+}
+
+// warns the overseer (while DF is running) when a check-out is about to expire, offering to ask for more time
+func watchExpirations(saveDir string, config ClientConfig, done chan bool) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	warnings := []time.Duration{time.Hour, 15 * time.Minute}
+	warned := make(map[string]time.Duration) // last warning given for each world
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			worldDirs, err := listDirs(saveDir)
+			if err != nil {
+				continue
+			}
+			for _, worldDir := range worldDirs {
+				token, err := readTokenFile(worldDir)
+				if err != nil {
+					continue
+				}
+				expires, err := time.Parse(time.RFC3339, token.Expires)
+				if err != nil {
+					continue
+				}
+				world := filepath.Base(worldDir)
+				remaining := time.Until(expires)
+				// the smallest warning time that has been reached, so that each one is given only once even if
+				// several are reached at the same time
+				var reached time.Duration
+				for _, w := range warnings {
+					if remaining <= w {
+						reached = w
+					}
+				}
+				if reached != 0 && (warned[world] == 0 || reached < warned[world]) {
+					warned[world] = reached
+					if askUser(fmt.Sprintf("Your check-out of world '%s' expires in %d minutes (at %s). Save your game and quit Dwarf Fortress to check it back in, or ask the server for more time. Ask for more time?",
+						world, int(remaining.Minutes()), expires.Local().Format("15:04")), "Check-out expiring!") {
+						wconfig, err := config.forServer(token.Server)
+						newToken := token
+						if err == nil {
+							newToken, err = extendCheckOut(worldDir, token, wconfig)
+						}
+						if err != nil {
+							errorPopup(fmt.Sprintf("Could not get more time for world '%s':\n%v", world, err))
+						} else {
+							delete(warned, world)
+							newExpires, _ := time.Parse(time.RFC3339, newToken.Expires)
+							infoPopup("More time!", fmt.Sprintf("Your check-out of world '%s' now expires at %s", world, newExpires.Local().Format("15:04")))
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func readTokenFile(worldDir string) (LockToken, error) {
+	var token LockToken
+	jstr, err := ioutil.ReadFile(filepath.Join(worldDir, "token.dftk"))
+	if err != nil {
+		return token, err
+	}
+	err = json.Unmarshal(jstr, &token)
+	return token, err
+}
+
+// asks the server for more time for a checked-out world, updating the token file with the new expiration time
+func extendCheckOut(worldDir string, token LockToken, config ClientConfig) (LockToken, error) {
+	world := filepath.Base(worldDir)
+	hostStr := fmt.Sprintf("%s:%d", config.HostName, config.PortNumber)
+	connection, err := dialServer(config.server)
+	if err != nil {
+		return token, errors.New(fmt.Sprintf("Failed to connect to server %s \n\t%v", hostStr, err))
+	}
+	defer connection.Close()
+	serverReader := bufio.NewReader(connection)
+	_, err = connection.Write(strToUtf8(fmt.Sprintf("%s:%s:%s:%s\n", COM_EXTEND, config.OverseerName, world, token.MagicRunes)))
+	if err != nil {
+		return token, err
+	}
+	resp, err := serverReader.ReadString('\n')
+	if err != nil {
+		return token, err
+	}
+	if strings.TrimSpace(resp) != RESP_SUCCESS {
+		return token, errors.New(resp)
+	}
+	jstr, err := serverReader.ReadString('\n')
+	if err != nil {
+		return token, err
+	}
+	var newToken LockToken
+	err = json.Unmarshal([]byte(jstr), &newToken)
+	if err != nil {
+		return token, err
+	}
+	newToken.Server = token.Server
+	return newToken, writeTokenFile(worldDir, newToken)
+}
+
+// downloads a read-only copy of the latest check-in of a world to the <world>-spectator save folder, without checking it out
+func peek(world string, saveDir string, config ClientConfig) error {
+	dirPath := filepath.Join(saveDir, fmt.Sprintf("%s-spectator", world))
+	if fileExists(dirPath) {
+		if !fileExists(filepath.Join(dirPath, "spectator.dftk")) {
+			return errors.New(fmt.Sprintf("Cannot download a copy of world %s because save folder %s already exists", world, dirPath))
+		}
+		// replace the old copy
+		err := setReadOnly(dirPath, false)
+		if err == nil {
+			err = deleteDir(dirPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	hostStr := fmt.Sprintf("%s:%d", config.HostName, config.PortNumber)
+	connection, err := dialServer(config.server)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to connect to server %s \n\t%v", hostStr, err))
+	}
+	defer connection.Close()
+	serverReader := bufio.NewReader(connection)
+	_, err = connection.Write(strToUtf8(fmt.Sprintf("%s:%s:%s\n", COM_PEEK, config.OverseerName, world)))
+	if err != nil {
+		return err
+	}
+	resp, err := serverReader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(resp) != RESP_DOWNLOAD {
+		return errors.New(resp)
+	}
+	jstr, err := serverReader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	var snap Snapshot
+	err = json.Unmarshal([]byte(jstr), &snap)
+	if err != nil {
+		return err
+	}
+	hash_, err := serverReader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	hash := strings.TrimSpace(hash_)
+	outFile, err := os.CreateTemp("", "CloudFort-peek.*.temp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outFile.Name())
+	err = recvFile(serverReader, outFile, true)
+	if err != nil {
+		outFile.Close()
+		return err
+	}
+	err = outFile.Close()
+	if err != nil {
+		return err
+	}
+	fhash, err := hashFile(outFile.Name())
+	if err != nil {
+		return err
+	}
+	if hash != fhash {
+		return errors.New(fmt.Sprintf("Download of world %s was corrupted (file hash mismatch)", world))
+	}
+	return extractSnapshot(outFile.Name(), dirPath, snap)
+}
+
+func cancelCheckOut(world string, overseer string, worldMagicRunes string, config ClientConfig) error {
+	// tell server to make this world available again without checking it back in
+	resp, err := textServer(config.server, fmt.Sprintf("%s:%s:%s:%s", COM_RELEASE, overseer, world, worldMagicRunes))
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(resp, RESP_ERROR) {
+		e := errors.New(resp)
+		return e
+	}
+	return nil
+}
+
+func sanityCheck(config ClientConfig) error {
+	if strings.ContainsRune(config.OverseerName, ':') {
+		return errors.New("Invalid overseer name: name must not contain ':'")
+	}
+	err := profileSanityCheck(config)
+	if err != nil {
+		return err
+	}
+	pollInterval, err := time.ParseDuration(config.PollInterval)
+	if err != nil || pollInterval < 10*time.Second {
+		return errors.New(fmt.Sprintf("Invalid PollInterval '%s': must be a duration of at least 10s", config.PollInterval))
+	}
+	if config.BackupsKept < 0 {
+		return errors.New("BackupsKept must not be negative")
+	}
+	if config.AutoCheckpoint != "" {
+		checkpointInterval, err := time.ParseDuration(config.AutoCheckpoint)
+		if err != nil || checkpointInterval < 5*time.Minute {
+			return errors.New(fmt.Sprintf("Invalid AutoCheckpoint '%s': must be a duration of at least 5m, or empty", config.AutoCheckpoint))
+		}
+	}
+	settleTime, err := time.ParseDuration(config.SaveSettleTime)
+	if err != nil || settleTime < 0 || settleTime > time.Minute {
+		return errors.New(fmt.Sprintf("Invalid SaveSettleTime '%s': must be a duration of at most 1m", config.SaveSettleTime))
+	}
+	return nil
+}
+
+func saveClientConfig(configFile string, config ClientConfig) error {
+	jstr, _ := json.MarshalIndent(config, "", "\t")
+	return ioutil.WriteFile(configFile, jstr, 0664)
+}
+
+func errCheck(e error) {
+	if e != nil {
+		logger.Errorf("%v", e)
+		errorPopup(fmt.Sprintf("%v", e))
+		os.Exit(1)
+	}
+}
+func errorPopup(msg string) {
+	dialog.Message("%s", msg).Title("Error!").Error()
+}
+func infoPopup(title, msg string) {
+	dialog.Message("%s", msg).Title(title).Info()
+}
+func askUser(question string, title string) bool {
+	yes := dialog.Message("%s", question).Title(title).YesNo()
+	return yes
+}
+
+func textServer(server ServerProfile, msg string) (string, error) {
+	hostStr := fmt.Sprintf("%s:%d", server.HostName, server.PortNumber)
+	connection, err := dialServer(server)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Failed to connect to server %s \n\t%v", hostStr, err))
+	}
+	defer connection.Close()
+	//
+	serverReader := bufio.NewReader(connection)
+	_, err = connection.Write(strToUtf8(fmt.Sprintf("%s\n", msg)))
+	logger.Debugf("Sent '%s'", msg)
+	if err != nil {
+		errMsg := fmt.Sprintf("I/O error: errChecked to send message to server \n\t%v", err)
+		return "", errors.New(errMsg)
+	}
+	serverResponse, err := serverReader.ReadString('\n')
+	logger.Debugf("Received '%s'", strings.TrimSpace(serverResponse))
+	return serverResponse, nil
+}
+
+// looks for the DF version in the release notes or in the name of the DF folder (eg df_47_05_linux)
+// returns "" if the version cannot be determined
+func detectDFVersion(dfDir string) string {
+	versionRegex := regexp.MustCompile(`(?i)(?:\bv|version\s*)(\d+\.\d+(?:\.\d+)?)`)
+	for _, notesFile := range []string{"release notes.txt", "readme.txt"} {
+		notes, err := ioutil.ReadFile(filepath.Join(dfDir, notesFile))
+		if err != nil {
+			continue
+		}
+		if len(notes) > 4096 {
+			notes = notes[:4096]
+		}
+		if m := versionRegex.FindSubmatch(notes); m != nil {
+			return normalizeDFVersion(string(m[1]))
+		}
+	}
+	folderRegex := regexp.MustCompile(`(?i)df_(\d+)_(\d+)(?:_|$)`)
+	if m := folderRegex.FindStringSubmatch(filepath.Base(dfDir)); m != nil {
+		// (eg df_47_05_linux is 0.47.05, but df_50_11_linux is 50.11)
+		if major, _ := strconv.Atoi(m[1]); major < 50 {
+			return normalizeDFVersion(fmt.Sprintf("0.%s.%s", m[1], m[2]))
+		}
+		return normalizeDFVersion(fmt.Sprintf("%s.%s", m[1], m[2]))
+	}
+	return ""
+}
+
+// returns the newest save format of the saves in the save folder that were not checked-out or downloaded from CloudFort
+// (those were made by the local copy of DF), or 0 if there are none
+func detectSaveFormat(saveDir string) uint32 {
+	saveDirs, err := listDirs(saveDir)
+	if err != nil {
+		return 0
+	}
+	newest := uint32(0)
+	for _, d := range saveDirs {
+		if fileExists(filepath.Join(d, "token.dftk")) || fileExists(filepath.Join(d, "spectator.dftk")) {
+			continue
+		}
+		for _, worldFile := range []string{"world.sav", "world.dat"} {
+			f, err := os.Open(filepath.Join(d, worldFile))
+			if err != nil {
+				continue
+			}
+			format, _, err := readSaveHeader(f)
+			f.Close()
+			if err == nil && format > newest {
+				newest = format
+			}
+			break
+		}
+	}
+	return newest
+}
+
+// picks the save layout of the local DF by its version, or else by the folders it has
+func detectSaveLayout(dfDir string, dfVersion string) *SaveLayout {
+	if layout := saveLayoutFor(dfVersion); layout != nil {
+		return layout
+	}
+	// DF 50 and later keep the vanilla raws in data/vanilla, older versions keep the saves in data/save
+	if fileExists(filepath.Join(dfDir, "data", "vanilla")) || (fileExists(filepath.Join(dfDir, "save")) && !fileExists(filepath.Join(dfDir, "data", "save"))) {
+		return saveLayoutFor("50")
+	}
+	return saveLayouts[0]
+}
+
+// the save folder of a layout: the first of its folders that exists, or else the first one in the DF folder
+func findSaveFolder(dfDir string, layout *SaveLayout) string {
+	for _, f := range layout.SaveFolders {
+		if fileExists(filepath.Join(dfDir, f)) {
+			return filepath.Join(dfDir, f)
+		}
+	}
+	if layout.UserFolder {
+		userDir, err := dfUserDataDir()
+		if err == nil && fileExists(filepath.Join(userDir, "save")) {
+			return filepath.Join(userDir, "save")
+		}
+	}
+	return filepath.Join(dfDir, layout.SaveFolders[0])
+}
+
+// where DF 50 and later keep the saves when they are not in the DF folder
+func dfUserDataDir() (string, error) {
+	var base string
+	var err error
+	if runtime.GOOS == "linux" {
+		base = os.Getenv("XDG_DATA_HOME")
+		if base == "" {
+			var home string
+			home, err = os.UserHomeDir()
+			base = filepath.Join(home, ".local", "share")
+		}
+	} else {
+		// %AppData% on windows, ~/Library/Application Support on Mac
+		base, err = os.UserConfigDir()
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "Bay 12 Games", "Dwarf Fortress"), nil
+}
+
+// the files (full paths) in a world folder that belong to its save, with the local save layout (or any layout if
+// the local one is not known) and the world's SaveFiles patterns
+func (localDF DFInstall) saveFiles(worldDir string, files []string, patterns []string) []string {
+	filter := isSaveFile
+	if localDF.Layout != nil {
+		filter = localDF.Layout.isSaveFile
+	}
+	saveFile := saveFileMatcher(filter, patterns)
+	return filterStrings(files, func(f string) bool {
+		rel, err := filepath.Rel(worldDir, f)
+		return err == nil && saveFile(rel)
+	})
+}
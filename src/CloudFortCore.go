@@ -1,114 +1,738 @@
-package main
-
-import (
-	"archive/zip"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"io/ioutil"
-	"path/filepath"
-	"regexp"
-)
-
-const CloudFortVersion = "1.0.0"
-
-const (
-	STATUS_AVAILABLE   = "available"
-	STATUS_DOWNLOADING = "downloading"
-	STATUS_CHECKOUT    = "checked-out"
-)
-
-const (
-	COM_CONCHECK = "DWARF"
-	COM_STATUS   = "status"
-	COM_CHECKOUT = "checkout"
-	COM_CHECKIN  = "checkin"
-	COM_RELEASE  = "release"
-)
-
-const (
-	RESP_CONCHECK = "FORTRESS"
-	RESP_DOWNLOAD = "download"
-	RESP_UPLOAD   = "upload"
-	RESP_ERROR    = "error"
-	RESP_SUCCESS  = "success"
-)
-
-type LockToken struct {
-	Status          string
-	Expires         string
-	CurrentOverseer string
-	MagicRunes      string // validation hash generated unique for each check-out to prevent the wrong world from being checked in
-}
-
-var saveRegexes []*regexp.Regexp
-
-func init() {
-	saveRegexes = SaveFileRegexes()
-}
-
-func SaveFileRegexes() []*regexp.Regexp {
-	regexStrs := []string{
-		`raw[/\\]graphics[/\\].*`,
-		`raw[/\\]objects[/\\].*\.txt`,
-		`art_image-\d*\.dat`,
-		`feature-\d*\.dat`,
-		`region_snapshot-\d*\.dat`,
-		`site-\d*\.dat`,
-		`unit-\d*\.dat`,
-		`world\.dat`,
-		`world\.sav`,
-	}
-	matchers := make([]*regexp.Regexp, 0, len(regexStrs))
-	for _, s := range regexStrs {
-		m := regexp.MustCompile(s)
-		matchers = append(matchers, m)
-	}
-	return matchers
-}
-
-// returns the root folder with world.dat|.sav
-// this function is needed because users may zip the whole folder or just the contents
-func findSaveZipRoot(zipPath string) (string, error) {
-	zr, err := zip.OpenReader(zipPath)
-	if err != nil {
-		return "", err
-	}
-	defer zr.Close()
-	for _, f := range zr.File {
-		n := filepath.Base(f.Name)
-		if n == "world.dat" || n == "world.sav" {
-			// in root of save
-			root := filepath.Dir(f.Name)
-			return root, nil
-		}
-	}
-	return "", errors.New("Neither world.dat nor world.sav could be found")
-}
-
-func extractSave(zipPath string, destDir string, token LockToken) error {
-	fmt.Printf("Extracting save files from %s to %s...\n", zipPath, destDir)
-	zroot, err := findSaveZipRoot(zipPath)
-	if err != nil {
-		return err
-	}
-	err = unzipFiles(zipPath, zroot, destDir, func(path string) bool {
-		for _, m := range saveRegexes {
-			if m.MatchString(path) {
-				return true
-			}
-		}
-		return false
-	})
-	if err != nil {
-		return err
-	}
-	tokenFileName := "token.dftk"
-	tokenPath := filepath.Join(destDir, tokenFileName)
-	jstr, err := json.MarshalIndent(token, "", "\t")
-	if err != nil {
-		return err
-	}
-	ioutil.WriteFile(tokenPath, jstr, 0664)
-	return nil
-}
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CloudFortVersion = "1.0.0"
+
+const (
+	STATUS_AVAILABLE   = "available"
+	STATUS_DOWNLOADING = "downloading"
+	STATUS_CHECKOUT    = "checked-out"
+	STATUS_INVALID     = "invalid"
+)
+
+const (
+	COM_CONCHECK   = "DWARF"
+	COM_STATUS     = "status"
+	COM_CHECKOUT   = "checkout"
+	COM_CHECKIN    = "checkin"
+	COM_RELEASE    = "release"
+	COM_EXTEND     = "extend"
+	COM_RESERVE    = "reserve"
+	COM_UNRESERVE  = "unreserve"
+	COM_PEEK       = "peek"
+	COM_CHECKPOINT = "checkpoint"
+	COM_AUTH       = "auth" // sent before the request to servers that have a password
+)
+
+const (
+	RESP_CONCHECK = "FORTRESS"
+	RESP_DOWNLOAD = "download"
+	RESP_UPLOAD   = "upload"
+	RESP_ERROR    = "error"
+	RESP_SUCCESS  = "success"
+)
+
+type LockToken struct {
+	Status          string
+	Expires         string
+	CurrentOverseer string
+	MagicRunes      string   // validation hash generated unique for each check-out to prevent the wrong world from being checked in
+	CheckedOut      string   `json:",omitempty"` // time of check-out, used to limit extensions
+	Server          string   `json:",omitempty"` // name of the client's server profile that the world was checked-out from (only in the client's token.dftk)
+	SaveFiles       []string `json:",omitempty"` // the world's save file patterns, sent with a check-out (see saveFileMatcher)
+}
+
+// WorldStatus is what the server reports for each world in a status listing
+// (the LockToken fields are embedded so that older clients can still read it)
+type WorldStatus struct {
+	LockToken
+	Problem       string    `json:",omitempty"` // reason why a world is invalid
+	Info          *SaveInfo `json:",omitempty"`
+	DFVersion     string    `json:",omitempty"` // version of Dwarf Fortress needed to play this world
+	Description   string    `json:",omitempty"`
+	Mods          []string  `json:",omitempty"`
+	Queue         []string  `json:",omitempty"` // overseers waiting for a turn, in order
+	ReservedFor   string    `json:",omitempty"` // overseer who may check-out this world next
+	ReservedUntil string    `json:",omitempty"`
+	Spectators    bool      `json:",omitempty"` // whether read-only copies of this world can be downloaded
+	Checkpoint    string    `json:",omitempty"` // time of the latest checkpoint of the current check-out
+}
+
+// Snapshot describes a read-only copy of a world that was downloaded by a spectator,
+// saved as spectator.dftk in the copy's folder instead of a token.dftk so that it is never checked-in
+type Snapshot struct {
+	World      string
+	Revision   string    // empty for the latest check-in
+	Info       *SaveInfo `json:",omitempty"`
+	Downloaded string    `json:",omitempty"`
+	SaveFiles  []string  `json:",omitempty"` // the world's extra save file patterns, as in LockToken
+}
+
+// SaveInfo is a summary of a world save, read from its zip file by readSaveInfo
+type SaveInfo struct {
+	Revision   string // hash of the zip file this info was read from
+	SaveFormat uint32 // save format version number from the header of world.sav (or world.dat)
+	Compressed bool
+	FolderName string // name of the save folder inside the zip
+	Year       int    // in-game year and season, if they can be determined from the folder name (0 and "" otherwise)
+	Season     string
+	SiteCount  int // number of site-*.dat files (one for each fortress or other site that has been visited)
+	UnitCount  int
+	FileCount  int
+	SaveSize   uint64 // uncompressed size in bytes
+	ZipSize    uint64 // compressed size in bytes
+}
+
+// SaveZipReport is the result of inspecting a zipped world save with validateSaveZip
+type SaveZipReport struct {
+	Root             string
+	SaveFiles        []string
+	UnexpectedFiles  []string
+	UncompressedSize uint64
+	Problems         []string // any problem makes the save unusable
+	Warnings         []string
+}
+
+// SaveLayout describes where a version of Dwarf Fortress keeps its saves and which files belong to a save
+type SaveLayout struct {
+	Name        string
+	MinVersion  int      // the first major version of DF that uses this layout (47 for 0.47.05)
+	SaveFolders []string // where the saves are, relative to the DF folder (the first one that exists is used)
+	UserFolder  bool     // whether the saves can be in the user's Bay 12 Games folder instead of the DF folder
+	RootFiles   []string // files that are only found at the root of a save, used to find it in a zip
+	FileRegexes []string // the files that belong to a save, relative to the save's folder
+	matchers    []*regexp.Regexp
+}
+
+// the known save layouts, oldest first
+var saveLayouts = []*SaveLayout{
+	{
+		Name:        "0.47",
+		SaveFolders: []string{filepath.Join("data", "save")},
+		RootFiles:   []string{"world.dat", "world.sav"},
+		FileRegexes: []string{
+			`^raw[/\\]graphics[/\\].*`,
+			`^raw[/\\]objects[/\\].*\.txt$`,
+			`^art_image-\d*\.dat$`,
+			`^feature-\d*\.dat$`,
+			`^region_snapshot-\d*\.dat$`,
+			`^site-\d*\.dat$`,
+			`^unit-\d*\.dat$`,
+			`^world\.dat$`,
+			`^world\.sav$`,
+		},
+	},
+	{
+		// the Steam/Premium releases, with the mods of a world in data/installed_mods inside its save
+		Name:        "50",
+		MinVersion:  50,
+		SaveFolders: []string{"save"},
+		UserFolder:  true,
+		RootFiles:   []string{"world.sav"},
+		FileRegexes: []string{
+			`^[\w-]+\.dat$`,
+			`^world\.sav$`,
+			`^data[/\\]installed_mods[/\\].*`,
+		},
+	},
+}
+
+func init() {
+	for _, l := range saveLayouts {
+		for _, s := range l.FileRegexes {
+			l.matchers = append(l.matchers, regexp.MustCompile(s))
+		}
+	}
+}
+
+// the save layout of a version of DF, or nil if the version is unknown
+func saveLayoutFor(dfVersion string) *SaveLayout {
+	parts := strings.Split(normalizeDFVersion(dfVersion), ".")
+	if len(parts) > 1 && parts[0] == "0" {
+		// 0.47.05 and older
+		parts = parts[1:]
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil
+	}
+	var layout *SaveLayout
+	for _, l := range saveLayouts {
+		if major >= l.MinVersion {
+			layout = l
+		}
+	}
+	return layout
+}
+
+// whether a file (relative to the save's folder) belongs to a save with this layout
+func (l *SaveLayout) isSaveFile(path string) bool {
+	for _, m := range l.matchers {
+		if m.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns a filter for the files (relative to the save's folder) of a world with SaveFiles patterns, which change what
+// the given filter accepts: a glob adds the files it matches (eg "dfhack-config/" or "*.json") and a glob starting with !
+// leaves them out (eg "!*.bak"), the last matching pattern winning
+// a glob without a / matches file names in any folder, one ending with / matches everything in the folders it matches
+// (CloudFort's own .dftk files are never part of a save)
+func saveFileMatcher(filter func(string) bool, patterns []string) func(string) bool {
+	return func(p string) bool {
+		if strings.HasSuffix(p, ".dftk") {
+			return false
+		}
+		keep := filter(p)
+		for _, pattern := range patterns {
+			if matchSavePattern(strings.TrimPrefix(pattern, "!"), filepath.ToSlash(p)) {
+				keep = !strings.HasPrefix(pattern, "!")
+			}
+		}
+		return keep
+	}
+}
+
+func matchSavePattern(pattern string, p string) bool {
+	pattern = filepath.ToSlash(pattern)
+	parts := strings.Split(p, "/")
+	if strings.HasSuffix(pattern, "/") {
+		// a folder: match the folders the file is in
+		pattern = strings.TrimSuffix(pattern, "/")
+		for i := 1; i < len(parts); i++ {
+			folder := strings.Join(parts[:i], "/")
+			if !strings.Contains(pattern, "/") {
+				folder = parts[i-1]
+			}
+			if ok, _ := path.Match(pattern, folder); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if !strings.Contains(pattern, "/") {
+		p = parts[len(parts)-1]
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// checks the syntax of SaveFiles patterns
+func checkSavePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		glob := strings.TrimSuffix(strings.TrimPrefix(pattern, "!"), "/")
+		if glob == "" {
+			return errors.New(fmt.Sprintf("Invalid save file pattern '%s'", pattern))
+		}
+		if _, err := path.Match(filepath.ToSlash(glob), ""); err != nil {
+			return errors.New(fmt.Sprintf("Invalid save file pattern '%s': %v", pattern, err))
+		}
+	}
+	return nil
+}
+
+// whether a file is at the root of a save of any layout, eg world.sav
+func isSaveRootFile(name string) bool {
+	for _, l := range saveLayouts {
+		for _, rf := range l.RootFiles {
+			if name == rf {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// returns the root folder with world.dat|.sav
+// this function is needed because users may zip the whole folder or just the contents
+// (if there is more than one, eg in a mod folder of the save, the one nearest to the top of the zip is the save's)
+func findSaveZipRoot(zipPath string) (string, error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	depth := func(dir string) int {
+		if dir == "." {
+			return 0
+		}
+		return strings.Count(filepath.ToSlash(dir), "/") + 1
+	}
+	root := ""
+	for _, f := range zr.File {
+		if !isSaveRootFile(filepath.Base(f.Name)) {
+			continue
+		}
+		dir := filepath.Dir(f.Name)
+		if root == "" || depth(dir) < depth(root) {
+			root = dir
+		}
+	}
+	if root == "" {
+		return "", errors.New("Neither world.dat nor world.sav could be found")
+	}
+	return root, nil
+}
+
+func (r SaveZipReport) IsValid() bool {
+	return len(r.Problems) == 0
+}
+
+// checks that a zip file contains a usable world save, without extracting it
+// sizeLimit is the maximum uncompressed size (in bytes) of the save files, or 0 for no limit
+// patterns are the world's SaveFiles patterns
+func validateSaveZip(zipPath string, sizeLimit uint64, patterns []string) (SaveZipReport, error) {
+	var report SaveZipReport
+	zroot, err := findSaveZipRoot(zipPath)
+	if err != nil {
+		report.Problems = append(report.Problems, err.Error())
+		return report, err
+	}
+	report.Root = zroot
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		report.Problems = append(report.Problems, err.Error())
+		return report, err
+	}
+	defer zr.Close()
+	saveFile := saveFileMatcher(isSaveFile, patterns)
+	foundWorld := false
+	fileTooBig := false
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if sizeLimit > 0 && zf.UncompressedSize64 > sizeLimit {
+			report.Problems = append(report.Problems, fmt.Sprintf("File %s is too big (%d MB)", zf.Name, zf.UncompressedSize64>>20))
+			fileTooBig = true
+		}
+		relPath, err := filepath.Rel(zroot, zf.Name)
+		if err != nil || strings.HasPrefix(filepath.ToSlash(relPath), "../") {
+			// outside of the save folder, will not be extracted
+			report.UnexpectedFiles = append(report.UnexpectedFiles, zf.Name)
+			continue
+		}
+		if !saveFile(relPath) {
+			report.UnexpectedFiles = append(report.UnexpectedFiles, zf.Name)
+			continue
+		}
+		if isSaveRootFile(relPath) {
+			foundWorld = true
+		}
+		report.SaveFiles = append(report.SaveFiles, relPath)
+		report.UncompressedSize += zf.UncompressedSize64
+	}
+	if !foundWorld {
+		report.Problems = append(report.Problems, "Neither world.dat nor world.sav could be found")
+	}
+	// (a file that is too big by itself was already reported)
+	if sizeLimit > 0 && report.UncompressedSize > sizeLimit && !fileTooBig {
+		report.Problems = append(report.Problems, fmt.Sprintf("Save is too big (%d MB uncompressed, limit is %d MB)", report.UncompressedSize>>20, sizeLimit>>20))
+	}
+	if len(report.UnexpectedFiles) > 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%d files are not part of a save and will be ignored (eg %s)", len(report.UnexpectedFiles), report.UnexpectedFiles[0]))
+	}
+	return report, nil
+}
+
+// whether a file (relative to the save's folder) belongs to a save of any layout
+// (the server and downloads accept every layout, the client only zips the files of its own)
+func isSaveFile(path string) bool {
+	for _, l := range saveLayouts {
+		if l.isSaveFile(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// reads the save format version and compression flag from the start of a world.sav or world.dat file
+func readSaveHeader(r io.Reader) (uint32, bool, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, false, err
+	}
+	version := binary.LittleEndian.Uint32(header[0:4])
+	compressed := binary.LittleEndian.Uint32(header[4:8]) != 0
+	return version, compressed, nil
+}
+
+// DF names backup and autosave folders after the in-game date, eg region1-spr-250 or region1-00250-04-01
+var seasonFolderRegex = regexp.MustCompile(`-(spr|sum|aut|win)-(\d+)`)
+var dateFolderRegex = regexp.MustCompile(`-(\d{5})-(\d{2})-(\d{2})`)
+
+func seasonFromFolderName(folderName string) (int, string) {
+	seasonNames := map[string]string{"spr": "Spring", "sum": "Summer", "aut": "Autumn", "win": "Winter"}
+	if m := seasonFolderRegex.FindStringSubmatch(folderName); m != nil {
+		year, _ := strconv.Atoi(m[2])
+		return year, seasonNames[m[1]]
+	}
+	if m := dateFolderRegex.FindStringSubmatch(folderName); m != nil {
+		year, _ := strconv.Atoi(m[1])
+		month, _ := strconv.Atoi(m[2])
+		seasons := []string{"Spring", "Summer", "Autumn", "Winter"}
+		if month >= 1 && month <= 12 {
+			return year, seasons[(month-1)/3]
+		}
+		return year, ""
+	}
+	return 0, ""
+}
+
+// summarizes the world save in a zip file (the Revision field is left for the caller to fill in)
+func readSaveInfo(zipPath string) (SaveInfo, error) {
+	var info SaveInfo
+	zroot, err := findSaveZipRoot(zipPath)
+	if err != nil {
+		return info, err
+	}
+	if zroot != "." {
+		info.FolderName = filepath.Base(zroot)
+		info.Year, info.Season = seasonFromFolderName(info.FolderName)
+	}
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return info, err
+	}
+	defer zr.Close()
+	var worldFile *zip.File
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		relPath, err := filepath.Rel(zroot, zf.Name)
+		if err != nil || !isSaveFile(relPath) {
+			continue
+		}
+		info.FileCount++
+		info.SaveSize += zf.UncompressedSize64
+		info.ZipSize += zf.CompressedSize64
+		name := filepath.Base(relPath)
+		if relPath == "world.sav" || (relPath == "world.dat" && worldFile == nil) {
+			worldFile = zf
+		} else if strings.HasPrefix(name, "site-") {
+			info.SiteCount++
+		} else if strings.HasPrefix(name, "unit-") {
+			info.UnitCount++
+		}
+	}
+	if worldFile == nil {
+		return info, errors.New("Neither world.dat nor world.sav could be found")
+	}
+	wr, err := worldFile.Open()
+	if err != nil {
+		return info, err
+	}
+	defer wr.Close()
+	info.SaveFormat, info.Compressed, err = readSaveHeader(wr)
+	if err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// one line description of a world save, for world selection lists
+func (info SaveInfo) String() string {
+	desc := fmt.Sprintf("save format %d, %d sites, %.1f MB", info.SaveFormat, info.SiteCount, float64(info.SaveSize)/(1024*1024))
+	if info.Year > 0 && info.Season != "" {
+		desc = fmt.Sprintf("%s of year %d, %s", info.Season, info.Year, desc)
+	} else if info.Year > 0 {
+		desc = fmt.Sprintf("year %d, %s", info.Year, desc)
+	}
+	return desc
+}
+
+// normalizes a DF version string so that eg "v0.47.05" and "0.47.5" compare as equal
+func normalizeDFVersion(v string) string {
+	v = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(v)), "v")
+	parts := strings.Split(v, ".")
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return v
+		}
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+func sameDFVersion(a, b string) bool {
+	return normalizeDFVersion(a) == normalizeDFVersion(b)
+}
+
+// checks that a name (eg an overseer name) is not empty and can be sent to the server
+func validateName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, r := range []rune{':', ';', '/', '\\', '\n', '\t', '%'} {
+		if strings.ContainsRune(name, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func extractSave(zipPath string, destDir string, token LockToken) error {
+	logger.Infof("Extracting save files from %s to %s...", zipPath, destDir)
+	zroot, err := findSaveZipRoot(zipPath)
+	if err != nil {
+		return err
+	}
+	err = unzipFiles(zipPath, zroot, destDir, saveFileMatcher(isSaveFile, token.SaveFiles))
+	if err != nil {
+		return err
+	}
+	return writeTokenFile(destDir, token)
+}
+
+// extracts a read-only copy of a world, marked with a spectator.dftk file
+func extractSnapshot(zipPath string, destDir string, snap Snapshot) error {
+	logger.Infof("Extracting read-only copy from %s to %s...", zipPath, destDir)
+	zroot, err := findSaveZipRoot(zipPath)
+	if err != nil {
+		return err
+	}
+	err = unzipFiles(zipPath, zroot, destDir, saveFileMatcher(isSaveFile, snap.SaveFiles))
+	if err != nil {
+		return err
+	}
+	jstr, err := json.MarshalIndent(snap, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(destDir, "spectator.dftk"), jstr, 0664)
+	if err != nil {
+		return err
+	}
+	return setReadOnly(destDir, true)
+}
+
+// the SHA-256 fingerprint of a (DER encoded) TLS certificate, as used for the TLSPin of client server profiles
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeTokenFile(worldDir string, token LockToken) error {
+	tokenFileName := "token.dftk"
+	tokenPath := filepath.Join(worldDir, tokenFileName)
+	jstr, err := json.MarshalIndent(token, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tokenPath, jstr, 0664)
+}
+
+const (
+	LOG_DEBUG = "debug"
+	LOG_INFO  = "info"
+	LOG_WARN  = "warn"
+	LOG_ERROR = "error"
+)
+
+var logLevels = map[string]int{LOG_DEBUG: 0, LOG_INFO: 1, LOG_WARN: 2, LOG_ERROR: 3}
+
+// LogConfig is the logging part of the client and server config files
+type LogConfig struct {
+	Level     string  // "debug", "info", "warn" or "error"
+	Format    string  // "text" or "json"
+	File      string  // log file, written as well as the console (empty for none)
+	MaxSizeMB float64 // the log file is rotated when it reaches this size
+	MaxFiles  int     // number of rotated log files to keep (<file>.1 is the newest)
+}
+
+func defaultLogConfig(logFile string) LogConfig {
+	return LogConfig{
+		Level:     LOG_INFO,
+		Format:    "text",
+		File:      logFile,
+		MaxSizeMB: 10,
+		MaxFiles:  5,
+	}
+}
+
+// where log messages go, shared by the logger and all of its request loggers
+type logOutput struct {
+	lock     sync.Mutex
+	config   LogConfig
+	level    int
+	file     *os.File
+	fileSize int64
+}
+
+// Logger writes leveled log messages; use withRequestID to tag the messages about one client request
+type Logger struct {
+	out       *logOutput
+	requestID string
+}
+
+// one line of a JSON log
+type logEntry struct {
+	Time    string
+	Level   string
+	Request string `json:",omitempty"`
+	Message string
+}
+
+var logger = Logger{out: &logOutput{config: defaultLogConfig(""), level: logLevels[LOG_INFO]}}
+
+// secrets are replaced with <redacted> before anything is logged
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)("(?:MagicRunes|Password|Secret|APIKey|Credentials|Authorization)"\s*:\s*)"[^"]*"`),
+	regexp.MustCompile(`(?i)((?:runes|password|secret|apikey)=)[^&\s]+`),
+	regexp.MustCompile(fmt.Sprintf(`\b((?:%s|%s|%s|%s):[^:\s]*:[^:\s]*:)[^\s']+`, COM_CHECKIN, COM_RELEASE, COM_EXTEND, COM_CHECKPOINT)),
+	regexp.MustCompile(fmt.Sprintf(`\b(%s:)[^\s']+`, COM_AUTH)),
+}
+
+func redactSecrets(s string) string {
+	s = secretPatterns[0].ReplaceAllString(s, `${1}"<redacted>"`)
+	for _, p := range secretPatterns[1:] {
+		s = p.ReplaceAllString(s, "${1}<redacted>")
+	}
+	return s
+}
+
+// applies the logging settings from a config file
+func setupLogging(lc LogConfig) error {
+	level, ok := logLevels[lc.Level]
+	if !ok {
+		return errors.New(fmt.Sprintf("Invalid log level '%s'", lc.Level))
+	}
+	if lc.Format != "text" && lc.Format != "json" {
+		return errors.New(fmt.Sprintf("Invalid log format '%s'", lc.Format))
+	}
+	o := logger.out
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.file != nil {
+		o.file.Close()
+		o.file = nil
+	}
+	o.config = lc
+	o.level = level
+	if lc.File != "" {
+		return o.openFile()
+	}
+	return nil
+}
+
+func (o *logOutput) openFile() error {
+	file, err := os.OpenFile(o.config.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	fstat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	o.file = file
+	o.fileSize = fstat.Size()
+	return nil
+}
+
+// renames <file> to <file>.1, <file>.1 to <file>.2 and so on, then starts a new log file
+func (o *logOutput) rotate() error {
+	o.file.Close()
+	o.file = nil
+	name := o.config.File
+	os.Remove(fmt.Sprintf("%s.%d", name, o.config.MaxFiles))
+	for i := o.config.MaxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", name, i), fmt.Sprintf("%s.%d", name, i+1))
+	}
+	if o.config.MaxFiles > 0 {
+		os.Rename(name, fmt.Sprintf("%s.1", name))
+	} else {
+		os.Remove(name)
+	}
+	return o.openFile()
+}
+
+func (l Logger) withRequestID(id string) Logger {
+	return Logger{out: l.out, requestID: id}
+}
+
+func (l Logger) Debugf(format string, args ...interface{}) {
+	l.write(LOG_DEBUG, fmt.Sprintf(format, args...))
+}
+
+func (l Logger) Infof(format string, args ...interface{}) {
+	l.write(LOG_INFO, fmt.Sprintf(format, args...))
+}
+
+func (l Logger) Warnf(format string, args ...interface{}) {
+	l.write(LOG_WARN, fmt.Sprintf(format, args...))
+}
+
+func (l Logger) Errorf(format string, args ...interface{}) {
+	l.write(LOG_ERROR, fmt.Sprintf(format, args...))
+}
+
+func (l Logger) write(level string, msg string) {
+	o := l.out
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if logLevels[level] < o.level {
+		return
+	}
+	msg = redactSecrets(strings.TrimRight(msg, "\n"))
+	tnow := time.Now()
+	var line string
+	if o.config.Format == "json" {
+		jstr, _ := json.Marshal(logEntry{
+			Time:    tnow.Format(time.RFC3339),
+			Level:   level,
+			Request: l.requestID,
+			Message: msg,
+		})
+		line = string(jstr) + "\n"
+	} else {
+		line = fmt.Sprintf("%s %-5s ", tnow.Format("2006-01-02 15:04:05"), strings.ToUpper(level))
+		if l.requestID != "" {
+			line += fmt.Sprintf("[%s] ", l.requestID)
+		}
+		line += msg + "\n"
+	}
+	os.Stdout.WriteString(line)
+	if o.file == nil {
+		return
+	}
+	if o.config.MaxSizeMB > 0 && o.fileSize+int64(len(line)) > int64(o.config.MaxSizeMB*1024*1024) {
+		if err := o.rotate(); err != nil {
+			os.Stdout.WriteString(fmt.Sprintf("Failed to rotate log file: %v\n", err))
+			return
+		}
+	}
+	n, _ := o.file.WriteString(line)
+	o.fileSize += int64(n)
+}
+
+// logs an error (if there is one) as a warning
+func (l Logger) Warn(e error) {
+	if e != nil {
+		l.Warnf("%v", e)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestIsSaveFile(t *testing.T) {
+	tests := []struct {
+		dfVersion string
+		path      string
+		want      bool
+	}{
+		{"0.47.05", "world.sav", true},
+		{"0.47.05", "world.dat", true},
+		{"0.47.05", "art_image-1.dat", true},
+		{"0.47.05", "unit-12.dat", true},
+		{"0.47.05", filepath.Join("raw", "objects", "creature_standard.txt"), true},
+		{"0.47.05", filepath.Join("raw", "graphics", "dwarves.png"), true},
+		{"0.47.05", "art_image-1.dat.old", false},
+		{"0.47.05", "world.sav.bak", false},
+		{"0.47.05", "old-world.sav", false},
+		{"0.47.05", filepath.Join("raw", "objects", "creature_standard.txt.bak"), false},
+		{"0.47.05", filepath.Join("backup", "raw", "objects", "creature_standard.txt"), false},
+		{"0.47.05", filepath.Join("backup", "unit-12.dat"), false},
+		{"50.11", "world.sav", true},
+		{"50.11", "art_image-1.dat", true},
+		{"50.11", filepath.Join("data", "installed_mods", "vanilla_text", "info.txt"), true},
+		{"50.11", "art_image-1.dat.old", false},
+		{"50.11", "world.sav.bak", false},
+		{"50.11", filepath.Join("backup", "world.sav"), false},
+	}
+	for _, tt := range tests {
+		layout := saveLayoutFor(tt.dfVersion)
+		if layout == nil {
+			t.Fatalf("no save layout for DF %s", tt.dfVersion)
+		}
+		if got := layout.isSaveFile(tt.path); got != tt.want {
+			t.Errorf("DF %s: isSaveFile(%q) = %v, want %v", tt.dfVersion, tt.path, got, tt.want)
+		}
+	}
+}
@@ -87,7 +87,7 @@ func listDirs(dirPath string) ([]string, error) {
 }
 
 func unzipFiles(zipPath string, zipRoot string, dirPath string, filterFunc func(string) bool) error {
-	fmt.Printf("Extracting files from %s in %s to %s\n", zipRoot, zipPath, dirPath)
+	logger.Debugf("Extracting files from %s in %s to %s", zipRoot, zipPath, dirPath)
 	zr, err := zip.OpenReader(zipPath)
 	if err != nil {
 		return err
@@ -104,6 +104,10 @@ func unzipFiles(zipPath string, zipRoot string, dirPath string, filterFunc func(
 		if err != nil {
 			return err
 		}
+		if strings.HasPrefix(filepath.ToSlash(relPath), "../") {
+			// never write outside of the destination folder
+			continue
+		}
 		if filterFunc(relPath) {
 			outPath := filepath.Join(dirPath, relPath)
 			outDir := filepath.Dir(outPath)
@@ -198,10 +202,42 @@ func scanDir(dirPath string) ([]string, error) {
 	return flist, nil
 }
 
+func copyFile(srcPath string, destPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dest, src)
+	if err != nil {
+		dest.Close()
+		return err
+	}
+	return dest.Close()
+}
+
 func deleteDir(dirPath string) error {
 	return os.RemoveAll(dirPath)
 }
 
+// makes the files in a folder (and its sub-folders) read-only, or writable again
+func setReadOnly(dirPath string, readOnly bool) error {
+	mode := os.FileMode(0664)
+	if readOnly {
+		mode = 0444
+	}
+	return filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return os.Chmod(path, mode)
+	})
+}
+
 func sendFile(r io.Reader, w io.Writer, numBytes int64, showProgBar bool) error {
 	sizeBuffer := make([]byte, 8)
 	binary.BigEndian.PutUint64(sizeBuffer, uint64(numBytes))
@@ -279,6 +315,15 @@ func minInt(a, b int64) int64 {
 	return a
 }
 
+func containsString(arr []string, s string) bool {
+	for _, a := range arr {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
+
 func filterStrings(arr []string, cond func(string) bool) []string {
 	result := make([]string, 0, len(arr))
 	for i := range arr {
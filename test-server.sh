@@ -0,0 +1,4 @@
+#!/bin/bash
+cd "$(dirname "$0")/src"
+go test CloudFort-Server.go CloudFort-Server-HTTP.go CloudFort-Server-Checkpoints.go CloudFort-Server-Dashboard.go CloudFort-Server-Email.go CloudFort-Server-Events.go CloudFort-Server-Metrics.go CloudFort-Server-Requests.go CloudFort-Server-Webhooks.go CloudFortCore.go Util.go DemoWorld.go CloudFort-Server-Dashboard_test.go CloudFort-Server-Email_test.go CloudFort-Server-Requests_test.go CloudFort-Server-Requests_fuzz_test.go CloudFort-Server-Webhooks_test.go CloudFortCore_test.go
+cd ..